@@ -3,8 +3,10 @@ package api
 import (
 	"github.com/mixedmachine/user-auth-server/pkg/controllers"
 	"github.com/mixedmachine/user-auth-server/pkg/db"
+	"github.com/mixedmachine/user-auth-server/pkg/mail"
 	"github.com/mixedmachine/user-auth-server/pkg/repository"
 	"github.com/mixedmachine/user-auth-server/pkg/routes"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
 
 	"io"
 	"log"
@@ -33,6 +35,49 @@ func Init() {
 }
 
 func RunUserAuthApiServer() {
+	if err := security.InitKeys(); err != nil {
+		log.Fatal("Could not load signing keys: ", err)
+	}
+	if err := security.InitIssuer(); err != nil {
+		log.Fatal("Could not configure the issuer: ", err)
+	}
+	if !security.OIDCEnabled() {
+		log.Println("OpenID Connect is disabled, it needs an RS256, ES256 or EdDSA JWT_SIGNING_METHOD")
+	}
+	if err := security.InitPasswordHasher(); err != nil {
+		log.Fatal("Could not configure password hashing: ", err)
+	}
+	if err := security.InitPasswordPolicy(); err != nil {
+		log.Fatal("Could not configure the password policy: ", err)
+	}
+	if err := security.InitBreachChecker(); err != nil {
+		log.Fatal("Could not load the breached password corpus: ", err)
+	}
+	if err := security.InitEmailVerification(); err != nil {
+		log.Fatal("Could not configure email verification: ", err)
+	}
+	if err := security.InitLoginThrottle(); err != nil {
+		log.Fatal("Could not configure the sign in throttle: ", err)
+	}
+	if err := security.InitTrustedProxies(); err != nil {
+		log.Fatal("Could not configure trusted proxies: ", err)
+	}
+	if err := security.InitOneTimeCodes(); err != nil {
+		log.Fatal("Could not configure one time codes: ", err)
+	}
+	if err := security.InitTOTP(); err != nil {
+		log.Fatal("Could not configure authenticator apps: ", err)
+	}
+	if err := security.InitWebAuthn(); err != nil {
+		log.Fatal("Could not configure passkeys: ", err)
+	}
+	if security.WebAuthn == nil {
+		log.Println("Passkeys are disabled, they need WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS")
+	}
+	if err := mail.InitMailer(); err != nil {
+		log.Fatal("Could not configure outbound mail: ", err)
+	}
+
 	mConn := db.NewMongoConnection()
 	rConn := db.NewRedisConnection()
 	defer mConn.Close()
@@ -41,6 +86,12 @@ func RunUserAuthApiServer() {
 	app := fiber.New(
 		fiber.Config{
 			CaseSensitive: true,
+			// Behind a load balancer, clients are told apart by the address
+			// it forwards, such as X-Forwarded-For. The header is only read
+			// from TRUSTED_PROXIES, as clients can send it themselves.
+			ProxyHeader:             security.ProxyHeader,
+			EnableTrustedProxyCheck: true,
+			TrustedProxies:          security.TrustedProxies,
 			ErrorHandler: func(c *fiber.Ctx, err error) error {
 				code := fiber.StatusInternalServerError
 				if e, ok := err.(*fiber.Error); ok {
@@ -64,15 +115,31 @@ func RunUserAuthApiServer() {
 
 	userRepo := repository.NewUserRepository(mConn)
 	tokenRepo := repository.NewTokenRepository(rConn)
+	clientRepo := repository.NewClientRepository(mConn)
+	auditRepo := repository.NewAuditRepository(mConn)
 	repos := map[string]interface{}{
-		"users":  userRepo,
-		"tokens": tokenRepo,
+		"users":   userRepo,
+		"tokens":  tokenRepo,
+		"clients": clientRepo,
+		"audit":   auditRepo,
 	}
 	authController := controllers.NewAuthController(repos)
 	userController := controllers.NewUserController(repos)
+	oauthController := controllers.NewOAuthController(repos)
+	sessionController := controllers.NewSessionController(repos)
 
-	authRoutes := routes.NewAuthRoutes(authController, userController)
+	guard := routes.NewPermissionGuard(repos)
+	limiter, err := routes.NewRateLimiter(rConn)
+	if err != nil {
+		log.Fatal("Could not configure rate limiting: ", err)
+	}
+
+	authRoutes := routes.NewAuthRoutes(authController, userController, guard, limiter)
 	authRoutes.Install(app)
+	oauthRoutes := routes.NewOAuthRoutes(oauthController, guard, limiter)
+	oauthRoutes.Install(app)
+	sessionRoutes := routes.NewSessionRoutes(sessionController)
+	sessionRoutes.Install(app)
 
 	run(app)
 }
@@ -89,7 +156,7 @@ func run(app *fiber.App) {
 		}
 	}()
 	sigChn := make(chan os.Signal, 1)
-	signal.Notify(sigChn, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChn, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		multiSignalHandler(<-sigChn)
 	}
@@ -104,6 +171,11 @@ func multiSignalHandler(sig os.Signal) {
 		log.Println("Signal:", sig.String())
 		log.Println("Process is killed.")
 		os.Exit(0)
+	case syscall.SIGHUP:
+		log.Println("Rotating signing keys...")
+		if err := security.RotateKeys(); err != nil {
+			log.Println("Key rotation failed:", err)
+		}
 	default:
 		log.Println("Unhandled/unknown signal")
 	}
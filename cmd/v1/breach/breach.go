@@ -0,0 +1,122 @@
+package breach
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const Command = "build-breach-filter"
+
+// Run builds a bloom filter from a SHA-1 hash file, one "<hash>:<count>"
+// line per password, or from a directory of "<prefix>.txt" range files as
+// published by Have I Been Pwned, for use as BREACHED_PASSWORDS_FILE
+func Run(args []string) {
+	flags := flag.NewFlagSet(Command, flag.ExitOnError)
+	in := flags.String("in", "", "SHA-1 hash file or directory of range files to read")
+	out := flags.String("out", "breached-passwords.bloom", "bloom filter file to write")
+	rate := flags.Float64("fp-rate", 0.001, "share of passwords wrongly reported as breached")
+	minCount := flags.Int64("min-count", 1, "skip hashes seen in fewer breaches than this")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s -in <hash file or range directory> [-out <filter>]\n", os.Args[0], Command)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if *in == "" || *rate <= 0 || *rate >= 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// The first pass counts the hashes to size the filter
+	n, err := eachHash(*in, *minCount, func([20]byte) {})
+	if err != nil {
+		log.Fatal("Could not read hash file: ", err)
+	}
+	filter := security.NewBloomFilter(n, *rate)
+	_, err = eachHash(*in, *minCount, filter.AddHash)
+	if err != nil {
+		log.Fatal("Could not read hash file: ", err)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatal("Could not create filter file: ", err)
+	}
+	writer := bufio.NewWriter(file)
+	_, err = filter.WriteTo(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		log.Fatal("Could not write filter file: ", err)
+	}
+	log.Printf("Wrote %d hashes to %s\n", n, *out)
+}
+
+// eachHash calls add for every hash in the hash file or range directory seen
+// at least minCount times and returns how many there were
+func eachHash(path string, minCount int64, add func([20]byte)) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return eachHashIn(path, "", minCount, add)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, entry := range entries {
+		prefix := strings.TrimSuffix(entry.Name(), ".txt")
+		if entry.IsDir() || len(prefix) != security.RangePrefixLen ||
+			strings.Trim(prefix, "0123456789ABCDEFabcdef") != "" {
+			continue
+		}
+		count, err := eachHashIn(filepath.Join(path, entry.Name()), prefix, minCount, add)
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// eachHashIn calls add for every hash in one file, whose lines are prefixed
+// with the range prefix of range files
+func eachHashIn(path, prefix string, minCount int64, add func([20]byte)) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var n uint64
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		sum, count, err := security.ParseHashLine(prefix + scanner.Text())
+		if err != nil {
+			return 0, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if count < minCount {
+			continue
+		}
+		add(sum)
+		n++
+	}
+	return n, scanner.Err()
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"github.com/mixedmachine/user-auth-server/cmd/v1/api"
+	"github.com/mixedmachine/user-auth-server/cmd/v1/breach"
+
+	"os"
 )
 
 // @title User Auth API
@@ -14,6 +17,11 @@ import (
 // @contact.url mixedmachine.dev
 // @contact.email michael.martinez.dev@gmail.com
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == breach.Command {
+		breach.Run(os.Args[2:])
+		return
+	}
+
 	api.Init()
 	api.RunUserAuthApiServer()
 }
@@ -23,7 +23,27 @@ type AuthController interface {
 	SignUp(ctx *fiber.Ctx) error
 	SignIn(ctx *fiber.Ctx) error
 	RefreshToken(ctx *fiber.Ctx) error
+	SignOut(ctx *fiber.Ctx) error
+	ForgotPassword(ctx *fiber.Ctx) error
+	ResetPassword(ctx *fiber.Ctx) error
+	VerifyEmail(ctx *fiber.Ctx) error
+	ResendVerification(ctx *fiber.Ctx) error
+	SignInMFA(ctx *fiber.Ctx) error
+	MagicSignIn(ctx *fiber.Ctx) error
+	VerifyMagicSignIn(ctx *fiber.Ctx) error
+	EnrollTOTP(ctx *fiber.Ctx) error
+	ConfirmTOTP(ctx *fiber.Ctx) error
+	DisableTOTP(ctx *fiber.Ctx) error
+	RegenerateRecoveryCodes(ctx *fiber.Ctx) error
+	BeginWebAuthnRegistration(ctx *fiber.Ctx) error
+	FinishWebAuthnRegistration(ctx *fiber.Ctx) error
+	BeginWebAuthnLogin(ctx *fiber.Ctx) error
+	FinishWebAuthnLogin(ctx *fiber.Ctx) error
+	BeginWebAuthnReauthentication(ctx *fiber.Ctx) error
+	GetWebAuthnCredentials(ctx *fiber.Ctx) error
+	DeleteWebAuthnCredential(ctx *fiber.Ctx) error
 	Authenticator(ctx *fiber.Ctx) error
+	Jwks(ctx *fiber.Ctx) error
 }
 
 // authController struct implements the AuthController interface
@@ -66,61 +86,78 @@ func (c *authController) Ping(ctx *fiber.Ctx) error {
 // @Tags Auth
 // @Accept json
 // @Produce json
-// @Param name body string true "Name"
-// @Param email body string true "Email"
-// @Param password body string true "Password"
-// @Param admin body bool false "Admin"
-// @Success 201 {object} models.User
-// @Failure 400 {object} util.JError
+// @Param user body models.SignUpInput true "New user"
+// @Success 201 {object} models.PublicUser
+// @Failure 400 {object} util.VError
+// @Failure 403 {object} util.JError
 // @Failure 422 {object} util.JError
 // @Router /api/v1/signup [post]
 func (c *authController) SignUp(ctx *fiber.Ctx) error {
-	var newUser models.User
-
-	err := ctx.BodyParser(&newUser)
+	var input models.SignUpInput
+	err := ctx.BodyParser(&input)
 	if err != nil {
 		return ctx.
 			Status(http.StatusUnprocessableEntity).
 			JSON(util.NewJError(err))
 	}
+	// Privileges are granted by an admin only, so asking for them is refused
+	// rather than silently ignored
+	var privileged struct {
+		Admin       bool     `json:"admin" form:"admin"`
+		Roles       []string `json:"roles" form:"roles"`
+		Permissions []string `json:"permissions" form:"permissions"`
+	}
+	err = ctx.BodyParser(&privileged)
+	if err != nil || privileged.Admin || len(privileged.Roles) > 0 || len(privileged.Permissions) > 0 {
+		return ctx.
+			Status(http.StatusForbidden).
+			JSON(util.NewJError(util.ErrPrivilegedField))
+	}
 
-	err = verifyUser(&newUser, c)
+	newUser := input.NewUser()
+	err = verifyUser(newUser, c)
 	if err != nil {
 		return ctx.
 			Status(http.StatusBadRequest).
-			JSON(util.NewJError(err))
+			JSON(errorBody(err))
 	}
 
 	newUser.CreatedAt = time.Now()
 	newUser.UpdatedAt = newUser.CreatedAt
 	newUser.Id = primitive.NewObjectID()
+	newUser.Roles = []string{security.RoleUser}
 
-	err = c.usersRepo.Save(&newUser)
+	err = c.usersRepo.Save(newUser)
 	if err != nil {
 		return ctx.
 			Status(http.StatusBadRequest).
 			JSON(util.NewJError(err))
 	}
+	sendEmailVerification(ctx, c.tokensRepo, newUser)
 
 	return ctx.
 		Status(http.StatusCreated).
-		JSON(newUser)
+		JSON(models.NewPublicUser(newUser))
 }
 
-// SignIn Handler Function verifies the user input and returns a new token
+// SignIn Handler Function verifies the user input and returns a new token, or an MFA
+// challenge when the user enrolled a second factor. Failed attempts slow down and
+// eventually lock out further ones, per address and per source IP.
 // @Summary Sign In
 // @Description Sign In
 // @Tags Auth
 // @Accept json
 // @Produce json
-// @Param email body string true "Email"
-// @Param password body string true "Password"
+// @Param credentials body models.SignInInput true "Credentials"
 // @Success 200 {object} map[string]interface{}
 // @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
 // @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
 // @Router /api/v1/signin [post]
 func (c *authController) SignIn(ctx *fiber.Ctx) error {
-	var input models.User
+	var input models.SignInInput
 	err := ctx.BodyParser(&input)
 	if err != nil {
 		return ctx.
@@ -129,9 +166,16 @@ func (c *authController) SignIn(ctx *fiber.Ctx) error {
 	}
 
 	input.Email = util.NormalizeEmail(input.Email)
+	// Throttling goes by the address before it is looked up, so it answers
+	// the same whether or not an account exists
+	if wait := c.signInWait(ctx, input.Email); wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+	}
+
 	user, err := c.usersRepo.GetByEmail(input.Email)
 	if err != nil {
 		log.Printf("c.usersRepo.GetByEmail| %s signin failed: %v\n", input.Email, err.Error())
+		c.failSignIn(ctx, input.Email)
 		return ctx.
 			Status(http.StatusUnauthorized).
 			JSON(util.NewJError(util.ErrInvalidCredentials))
@@ -140,85 +184,154 @@ func (c *authController) SignIn(ctx *fiber.Ctx) error {
 	err = security.VerifyPassword(user.Password, input.Password)
 	if err != nil {
 		log.Printf("security.VerifyPassword| %s signin failed: %v\n", input.Email, err.Error())
+		c.failSignIn(ctx, input.Email)
 		return ctx.
 			Status(http.StatusUnauthorized).
 			JSON(util.NewJError(util.ErrInvalidCredentials))
 	}
-
-	token, err := security.NewToken(user.Id.Hex())
-	if err != nil {
-		log.Printf("security.NewToken| %s signin failed: %v\n", input.Email, err.Error())
-		return ctx.
-			Status(http.StatusUnauthorized).
-			JSON(util.NewJError(err))
+	if security.NeedsRehash(user.Password) {
+		c.rehashPassword(user, input.Password)
 	}
-	err = c.tokensRepo.Create(token, user.Id.Hex(), true)
-	if err != nil {
-		log.Printf("c.tokensRepo.Create| %s signin failed: %v\n", input.Email, err.Error())
+	// Only tell whether the address is verified once the password proved
+	// the caller owns the account
+	if security.RequireVerifiedEmail && !user.EmailVerified {
 		return ctx.
-			Status(http.StatusUnauthorized).
-			JSON(util.NewJError(err))
+			Status(http.StatusForbidden).
+			JSON(util.NewJError(util.ErrEmailNotVerified))
 	}
 
-	return ctx.
-		Status(http.StatusOK).
-		JSON(fiber.Map{
-			"user":  user,
-			"token": token,
-		})
+	return c.continueSignIn(ctx, user)
 }
 
-// RefreshToken Handler Function verifies the user input removes old token and returns a new token
+// RefreshToken Handler Function exchanges a refresh token for a new access token and a
+// rotated refresh token. Presenting a refresh token that was already used revokes every
+// token in its family.
 // @Summary Refresh Token
 // @Description Refresh Token
 // @Tags Auth
 // @Accept json
 // @Produce json
-// @Param Authorization header string true "specific user token"
+// @Param refresh_token body string true "Refresh token"
 // @Success 200 {object} map[string]interface{}
 // @Failure 401 {object} util.JError
 // @Failure 422 {object} util.JError
 // @Router /api/v1/refresh [post]
 func (c *authController) RefreshToken(ctx *fiber.Ctx) error {
-	userId, err := AuthRequest(ctx, c.tokensRepo)
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := ctx.BodyParser(&input)
 	if err != nil {
-		log.Printf("AuthRequest| %s refresh failed: %v\n", userId, err.Error())
 		return ctx.
-			Status(http.StatusUnauthorized).
+			Status(http.StatusUnprocessableEntity).
 			JSON(util.NewJError(err))
 	}
-
-	token, err := security.NewToken(userId)
-	if err != nil {
-		log.Printf("security.NewToken| %s refresh failed: %v\n", userId, err.Error())
+	if input.RefreshToken == "" {
 		return ctx.
 			Status(http.StatusUnauthorized).
-			JSON(util.NewJError(err))
+			JSON(util.NewJError(util.ErrInvalidRefreshToken))
 	}
 
-	err = c.tokensRepo.Create(token, userId, true)
+	refresh, err := c.tokensRepo.UseRefresh(input.RefreshToken)
+	if err == util.ErrRefreshTokenReused {
+		log.Printf("c.tokensRepo.UseRefresh| %s refresh token reused, revoking family %s\n", refresh.User, refresh.Family)
+		if err := c.tokensRepo.RevokeFamily(refresh.Family); err != nil {
+			log.Printf("c.tokensRepo.RevokeFamily| %s revoke failed: %v\n", refresh.User, err.Error())
+		}
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(util.ErrRefreshTokenReused))
+	}
 	if err != nil {
-		log.Printf("c.tokensRepo.Create| %s refresh failed: %v\n", userId, err.Error())
+		log.Printf("c.tokensRepo.UseRefresh| refresh failed: %v\n", err.Error())
 		return ctx.
 			Status(http.StatusUnauthorized).
-			JSON(util.NewJError(err))
+			JSON(util.NewJError(util.ErrInvalidRefreshToken))
 	}
 
-	err = c.tokensRepo.Delete(string(ctx.Request().Header.Peek("Authorization")))
+	token, refreshToken, err := issueTokens(ctx, c.tokensRepo, *refresh)
 	if err != nil {
-		log.Printf("c.tokensRepo.Delete| %s refresh failed: %v\n", userId, err.Error())
+		log.Printf("issueTokens| %s refresh failed: %v\n", refresh.User, err.Error())
 		return ctx.
 			Status(http.StatusUnauthorized).
 			JSON(util.NewJError(err))
 	}
 
+	// Drop the access token being replaced, if the client sent one of its own
+	if userId, err := AuthRequest(ctx, c.tokensRepo); err == nil && userId == refresh.User {
+		err = c.tokensRepo.Delete(authToken(ctx))
+		if err != nil {
+			log.Printf("c.tokensRepo.Delete| %s refresh failed: %v\n", refresh.User, err.Error())
+		}
+	}
+
 	return ctx.
 		Status(http.StatusOK).
 		JSON(fiber.Map{
-			"token": token,
+			"token":         token,
+			"refresh_token": refreshToken,
 		})
 }
 
+// SignOut Handler Function revokes the caller's session, meaning the access token used for
+// the request together with the refresh tokens issued alongside it. With "all" set every
+// session of the user is revoked.
+// @Summary Sign Out
+// @Description Sign Out
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param all body bool false "Sign out of every session"
+// @Success 204
+// @Failure 401 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/signout [post]
+func (c *authController) SignOut(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var input struct {
+		All bool `json:"all"`
+	}
+	if len(ctx.Body()) > 0 {
+		err = ctx.BodyParser(&input)
+		if err != nil {
+			return ctx.
+				Status(http.StatusUnprocessableEntity).
+				JSON(util.NewJError(err))
+		}
+	}
+
+	token := authToken(ctx)
+	switch claims, _ := security.ParseToken(token); {
+	case input.All:
+		err = c.tokensRepo.RevokeUser(userId)
+	case claims != nil && claims.Session != "":
+		err = c.tokensRepo.RevokeFamily(claims.Session)
+	default:
+		err = c.tokensRepo.Delete(token)
+	}
+	if err != nil {
+		log.Printf("c.tokensRepo| %s signout failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	// Make sure the presented token is gone even if it was not in a session
+	err = c.tokensRepo.Delete(token)
+	if err != nil {
+		log.Printf("c.tokensRepo.Delete| %s signout failed: %v\n", userId, err.Error())
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
 // Authenticator Handler Function takes the token from the request header and returns the user id
 // associated with the token
 // @Summary Authenticator
@@ -245,10 +358,114 @@ func (c *authController) Authenticator(ctx *fiber.Ctx) error {
 		})
 }
 
+// Jwks Handler Function publishes the public keys used to sign tokens so other
+// services can verify them offline
+// @Summary JSON Web Key Set
+// @Description Public keys for token signature verification
+// @Tags Auth
+// @Accept */*
+// @Produce json
+// @Success 200 {object} security.JWKS
+// @Router /.well-known/jwks.json [get]
+func (c *authController) Jwks(ctx *fiber.Ctx) error {
+	return ctx.
+		Status(http.StatusOK).
+		JSON(security.PublicJWKS())
+}
+
 /********************************************************
 * 					Helper functions					*
 *********************************************************/
 
+// signInWait returns how long the caller has to wait before trying to sign in
+// with the address again. Failing to tell lets the attempt through.
+func (c *authController) signInWait(ctx *fiber.Ctx, email string) time.Duration {
+	wait, err := c.tokensRepo.LoginWait(email, ClientIP(ctx))
+	if err != nil {
+		log.Printf("c.tokensRepo.LoginWait| %s signin failed: %v\n", email, err.Error())
+	}
+	return wait
+}
+
+// failSignIn counts a failed sign in with the address from the caller's IP,
+// whichever factor failed. Failing to count must not change the answer, so
+// errors are only logged.
+func (c *authController) failSignIn(ctx *fiber.Ctx, email string) {
+	err := c.tokensRepo.FailLogin(email, ClientIP(ctx))
+	if err != nil {
+		log.Printf("c.tokensRepo.FailLogin| %s signin failed: %v\n", email, err.Error())
+	}
+}
+
+// continueSignIn follows a passed first factor. With a second factor
+// enrolled, it only earns a challenge that is answered at /signin/mfa or with
+// a passkey; otherwise the user is signed in.
+func (c *authController) continueSignIn(ctx *fiber.Ctx, user *models.User) error {
+	if !user.MFAEnabled() {
+		return c.completeSignIn(ctx, user)
+	}
+	challenge, err := security.NewOpaqueToken()
+	if err == nil {
+		err = c.tokensRepo.CreateMFAChallenge(challenge, user.Id.Hex())
+	}
+	if err != nil {
+		log.Printf("c.tokensRepo.CreateMFAChallenge| %s signin failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"mfa_methods":  mfaMethods(user),
+		})
+}
+
+// completeSignIn issues the tokens of a new session to a user who passed
+// every factor required to sign in. Only then are failed sign ins forgotten,
+// as a right password alone doesn't prove the caller owns the account.
+func (c *authController) completeSignIn(ctx *fiber.Ctx, user *models.User) error {
+	token, refreshToken, err := issueTokens(ctx, c.tokensRepo, models.RefreshToken{User: user.Id.Hex()})
+	if err != nil {
+		log.Printf("issueTokens| %s signin failed: %v\n", user.Email, err.Error())
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.ClearLoginFailures(user.Email)
+	if err != nil {
+		log.Printf("c.tokensRepo.ClearLoginFailures| %s signin failed: %v\n", user.Email, err.Error())
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"user":             models.NewPublicUser(user),
+			"token":            token,
+			"refresh_token":    refreshToken,
+			"password_expired": security.PasswordExpired(user),
+		})
+}
+
+// rehashPassword replaces a password hash made with an outdated algorithm or
+// parameters. Signing in does not depend on it, so failures are only logged.
+func (c *authController) rehashPassword(user *models.User, password string) {
+	hashed, err := security.EncryptPassword(password)
+	if err != nil {
+		log.Printf("security.EncryptPassword| %s rehash failed: %v\n", user.Email, err.Error())
+		return
+	}
+	user.Password = hashed
+	err = c.usersRepo.Update(user)
+	if err != nil {
+		log.Printf("c.usersRepo.Update| %s rehash failed: %v\n", user.Email, err.Error())
+		return
+	}
+	log.Printf("Upgraded password hash of user %s\n", user.Id.Hex())
+}
+
 // verifyUser verifies the user input and returns an error if the input is invalid
 func verifyUser(user *models.User, c *authController) error {
 	if user == nil {
@@ -269,21 +486,25 @@ func verifyUser(user *models.User, c *authController) error {
 		return util.ErrInvalidEmail
 	}
 
-	exists, err := c.usersRepo.GetByEmail(user.Email)
-	if err != mongo.ErrNoDocuments {
-		return err
+	_, err := c.usersRepo.GetByEmail(user.Email)
+	if err == nil {
+		return util.ErrEmailAlreadyExists
 	}
-
-	if exists != nil {
-		err = util.ErrEmailAlreadyExists
+	if err != mongo.ErrNoDocuments {
 		return err
 	}
 
 	if strings.TrimSpace(user.Password) == "" {
 		return util.ErrEmptyPassword
 	}
+	err = security.CheckPassword(user.Password, user.Email, user.Name)
+	if err != nil {
+		return err
+	}
 
-	user.Password, err = security.EncryptPassword(user.Password)
+	password := user.Password
+	user.Password = ""
+	err = security.SetPassword(user, password)
 	if err != nil {
 		return err
 	}
@@ -1,26 +1,220 @@
 package controllers
 
 import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
 	"github.com/mixedmachine/user-auth-server/pkg/repository"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
 	"github.com/mixedmachine/user-auth-server/pkg/util"
 
+	"errors"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	bearerScheme = "Bearer "
+
+	// clientSubjectPrefix marks tokens issued to an OAuth client rather than a user
+	clientSubjectPrefix = "client:"
+
+	// sessionTouchInterval is how often the use of a session is recorded at
+	// most, as every authenticated request would otherwise write to Redis
+	sessionTouchInterval = time.Minute
+)
+
+// sessionTouches remembers when this instance last recorded the use of each session
+var sessionTouches = &touchThrottle{last: map[string]time.Time{}}
+
+// AuthRequest authenticates a request to the first-party API and returns the
+// user it is made for. Tokens issued to OAuth clients are refused: a user
+// only consented to their scope, not to the client acting as them here.
 func AuthRequest(ctx *fiber.Ctx, tokensRepo repository.TokenRepository) (string, error) {
-	token := string(ctx.Request().Header.Peek("Authorization"))
-	// log.Printf("Token: %s\n", token)
+	user, claims, err := authClaims(ctx, tokensRepo)
+	if err != nil {
+		return "", err
+	}
+	if claims.ClientId != "" {
+		log.Printf("AuthRequest| %s token of client %s refused for %s %s\n", user, claims.ClientId, ctx.Method(), ctx.Path())
+		return "", util.ErrClientToken
+	}
+	return user, nil
+}
+
+// authClaims authenticates a request by its bearer token, whoever it was
+// issued to, and returns the token's subject and claims. Callers accepting
+// tokens of OAuth clients have to check the scope themselves.
+func authClaims(ctx *fiber.Ctx, tokensRepo repository.TokenRepository) (string, *security.Claims, error) {
+	token := authToken(ctx)
 	if token == "" {
-		return "", util.ErrInvalidAuthToken
+		return "", nil, util.ErrInvalidAuthToken
 	}
 	user, err := tokensRepo.Retrieve(token)
-	if user == "" || err != nil {
+	if user == "" || err != nil || strings.HasPrefix(user, clientSubjectPrefix) {
 		log.Printf("User: %s\n", user)
 		log.Printf("Error: %s\n", err)
-		return "", util.ErrUnauthorized
+		return "", nil, util.ErrUnauthorized
+	}
+	claims, err := security.ParseToken(token)
+	if err != nil {
+		return "", nil, util.ErrUnauthorized
 	}
 
-	return user, nil
+	if claims.Session != "" && sessionTouches.due(claims.Session, time.Now()) {
+		touchSession(ctx, tokensRepo, claims.Session, user, claims.ClientId)
+	}
+	return user, claims, nil
+}
+
+// authToken returns the token from the Authorization header. Both the bare
+// token and the "Bearer <token>" form used by OAuth clients are accepted.
+func authToken(ctx *fiber.Ctx) string {
+	token := string(ctx.Request().Header.Peek("Authorization"))
+	if len(token) > len(bearerScheme) && strings.EqualFold(token[:len(bearerScheme)], bearerScheme) {
+		return token[len(bearerScheme):]
+	}
+	return token
+}
+
+// issueTokens creates an access token and a refresh token for the grant and
+// stores both. A grant without a family starts a new token family, and with it
+// a new session.
+func issueTokens(ctx *fiber.Ctx, tokensRepo repository.TokenRepository, grant models.RefreshToken) (string, string, error) {
+	if grant.Family == "" {
+		grant.Family = primitive.NewObjectID().Hex()
+	}
+	token, err := security.NewScopedToken(grant.User, grant.ClientId, grant.Scope, grant.Family)
+	if err != nil {
+		return "", "", err
+	}
+	err = tokensRepo.Create(token, grant.User, true)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := security.NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	err = tokensRepo.CreateRefresh(refreshToken, token, &grant)
+	if err != nil {
+		return "", "", err
+	}
+	touchSession(ctx, tokensRepo, grant.Family, grant.User, grant.ClientId)
+
+	return token, refreshToken, nil
+}
+
+// touchSession updates the last use of a session with the caller's address and
+// user agent. Failing to do so must not fail the request, so errors are only logged.
+func touchSession(ctx *fiber.Ctx, tokensRepo repository.TokenRepository, id, user, clientId string) {
+	err := tokensRepo.TouchSession(&models.Session{
+		Id:        id,
+		User:      user,
+		ClientId:  clientId,
+		IP:        ClientIP(ctx),
+		UserAgent: string(ctx.Request().Header.UserAgent()),
+	})
+	if err != nil {
+		log.Printf("tokensRepo.TouchSession| %s session %s failed: %v\n", user, id, err.Error())
+		return
+	}
+	sessionTouches.touched(id, time.Now())
+}
+
+// touchThrottle tracks when sessions were last touched. Sessions not touched
+// within the interval are swept out, so it only holds recently used ones.
+type touchThrottle struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	lastSweep time.Time
+}
+
+// due reports whether the session id was not touched within the interval
+func (t *touchThrottle) due(id string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.last[id]
+	return !ok || now.Sub(last) >= sessionTouchInterval
+}
+
+// touched remembers that the session id was touched at now
+func (t *touchThrottle) touched(id string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= sessionTouchInterval {
+		for session, last := range t.last {
+			if now.Sub(last) >= sessionTouchInterval {
+				delete(t.last, session)
+			}
+		}
+		t.lastSweep = now
+	}
+	t.last[id] = now
+}
+
+// recordAudit stores that actorId performed action on targetId. Failing to
+// do so must not fail the request, so errors are only logged.
+func recordAudit(ctx *fiber.Ctx, auditRepo repository.AuditRepository, actorId, action, targetId string) {
+	err := auditRepo.Record(&models.AuditEntry{
+		Id:        primitive.NewObjectID(),
+		Actor:     actorId,
+		Action:    action,
+		Target:    targetId,
+		IP:        ClientIP(ctx),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("c.auditRepo.Record| %s %s %s failed: %v\n", actorId, action, targetId, err.Error())
+	}
+}
+
+// errorBody returns the response body for err, listing every violation when
+// err reports several
+func errorBody(err error) interface{} {
+	var verr *util.ViolationsError
+	if errors.As(err, &verr) {
+		return util.NewVError(verr)
+	}
+	return util.NewJError(err)
+}
+
+// tooManyRequests answers a throttled request with err, telling the client
+// to retry after wait
+func tooManyRequests(ctx *fiber.Ctx, wait time.Duration, err error) error {
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return ctx.
+		Status(http.StatusTooManyRequests).
+		JSON(util.NewJError(err))
+}
+
+// ClientIP returns the address of the client that made the request. Behind
+// trusted proxies it is the rightmost address of the proxy header that isn't
+// one of them: every proxy appends the address it was reached from, while the
+// addresses left of the first untrusted one are whatever the client sent.
+func ClientIP(ctx *fiber.Ctx) string {
+	client := ctx.Context().RemoteIP()
+	if security.ProxyHeader == "" || !ctx.IsProxyTrusted() {
+		return client.String()
+	}
+	hops := strings.Split(ctx.Get(security.ProxyHeader), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !security.TrustedProxy(ip) {
+			break
+		}
+	}
+	return client.String()
 }
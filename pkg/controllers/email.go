@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/mail"
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/repository"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// resendVerificationMessage is answered to every resend request, so it can't
+// tell whether an account exists or is verified already
+const resendVerificationMessage = "If the address belongs to an unverified account, a verification link has been sent to it"
+
+/********************************************************
+ *		Handler Functions for Email Verification		*
+ ********************************************************/
+
+// VerifyEmail Handler Function marks the address of a user verified with the token from a
+// verification link
+// @Summary Verify Email
+// @Description Verify an email address with the token from a verification link
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param token body string true "Email verification token"
+// @Success 200 {object} models.PublicUser
+// @Failure 400 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/email/verify [post]
+func (c *authController) VerifyEmail(ctx *fiber.Ctx) error {
+	var input struct {
+		Token string `json:"token" form:"token"`
+	}
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	userId, email, err := c.tokensRepo.ConsumeVerificationToken(input.Token)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidVerificationToken))
+	}
+	user, err := c.usersRepo.GetById(userId)
+	// A link sent to an address the user has since replaced proves nothing
+	if err != nil || user.Email != email {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidVerificationToken))
+	}
+
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now()
+		err = c.usersRepo.Update(user)
+		if err != nil {
+			log.Printf("c.usersRepo.Update| %s verify email failed: %v\n", userId, err.Error())
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+		log.Printf("Email of user %s was verified\n", userId)
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(models.NewPublicUser(user))
+}
+
+// ResendVerification Handler Function sends a new verification link to the address if it
+// belongs to an unverified account. Each address can be sent one link per resend interval.
+// @Summary Resend Verification Email
+// @Description Request a new email verification link
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param email body string true "Email"
+// @Success 202 {object} map[string]string
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Router /api/v1/email/verify/resend [post]
+func (c *authController) ResendVerification(ctx *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email" form:"email"`
+	}
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	email := util.NormalizeEmail(input.Email)
+
+	// The address is throttled whether or not it has an account, so being
+	// throttled doesn't tell either
+	wait, err := c.tokensRepo.ThrottleVerification(email)
+	if err != nil {
+		log.Printf("c.tokensRepo.ThrottleVerification| %s resend verification failed: %v\n", email, err.Error())
+	}
+	if wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrVerificationThrottled)
+	}
+
+	user, err := c.usersRepo.GetByEmail(email)
+	if err == nil && !user.EmailVerified {
+		mailVerificationLink(ctx, c.tokensRepo, user)
+	}
+	return ctx.
+		Status(http.StatusAccepted).
+		JSON(fiber.Map{
+			"message": resendVerificationMessage,
+		})
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// sendEmailVerification sends a verification link for the user's current
+// address. It is used whenever an address is set, so it is never throttled
+// itself, but it does start the resend interval.
+func sendEmailVerification(ctx *fiber.Ctx, tokensRepo repository.TokenRepository, user *models.User) {
+	_, err := tokensRepo.ThrottleVerification(user.Email)
+	if err != nil {
+		log.Printf("tokensRepo.ThrottleVerification| %s send verification failed: %v\n", user.Id.Hex(), err.Error())
+	}
+	mailVerificationLink(ctx, tokensRepo, user)
+}
+
+// mailVerificationLink creates a single use verification link for the user's
+// address and mails it to them
+func mailVerificationLink(ctx *fiber.Ctx, tokensRepo repository.TokenRepository, user *models.User) {
+	token, err := security.NewOpaqueToken()
+	if err != nil {
+		log.Printf("security.NewOpaqueToken| %s send verification failed: %v\n", user.Id.Hex(), err.Error())
+		return
+	}
+	err = tokensRepo.CreateVerificationToken(token, user.Id.Hex(), user.Email)
+	if err != nil {
+		log.Printf("tokensRepo.CreateVerificationToken| %s send verification failed: %v\n", user.Id.Hex(), err.Error())
+		return
+	}
+	link := withQuery(mail.EmailVerificationURL, url.Values{"token": {token}})
+	sendMail(ctx, mail.KindVerifyEmail, user, mail.Data{"Link": link})
+}
+
+// sendMail mails a message of kind rendered with data to the user, in the
+// language the request prefers. Delivery is queued and retried, so failing to
+// send never fails the request; problems are only logged.
+func sendMail(ctx *fiber.Ctx, kind string, user *models.User, data mail.Data) {
+	values := mail.Data{"Name": user.Name}
+	for k, v := range data {
+		values[k] = v
+	}
+	msg, err := mail.Render(kind, mail.Locale(ctx.Get(fiber.HeaderAcceptLanguage)), values)
+	if err != nil {
+		log.Printf("mail.Render| %s send %s failed: %v\n", user.Id.Hex(), kind, err.Error())
+		return
+	}
+	msg.To = user.Email
+	err = mail.Outbox.Send(msg)
+	if err != nil {
+		log.Printf("mail.Outbox.Send| %s send %s failed: %v\n", user.Id.Hex(), kind, err.Error())
+	}
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/mail"
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	magicMethodLink = "link"
+	magicMethodCode = "code"
+
+	// magicSignInMessage is answered to every passwordless sign in request,
+	// so it can't tell whether an account exists
+	magicSignInMessage = "If the address belongs to an account, a sign in email has been sent to it"
+)
+
+/********************************************************
+ *		Handler Functions for Passwordless Sign In		*
+ ********************************************************/
+
+// MagicSignIn Handler Function emails a single use sign in link or code to the address if it
+// belongs to an account. The response is the same either way, and each address can be sent
+// one email per resend interval.
+// @Summary Passwordless Sign In
+// @Description Request a sign in link or a 6 digit sign in code by email
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body models.MagicSignInInput true "Email and link or code"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Router /api/v1/signin/magic [post]
+func (c *authController) MagicSignIn(ctx *fiber.Ctx) error {
+	var input models.MagicSignInInput
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	if input.Method == "" {
+		input.Method = magicMethodLink
+	}
+	if input.Method != magicMethodLink && input.Method != magicMethodCode {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrUnsupportedSignInMethod))
+	}
+	email := util.NormalizeEmail(input.Email)
+
+	// The address is throttled whether or not it has an account, so being
+	// throttled doesn't tell either
+	wait, err := c.tokensRepo.ThrottleMagicSignIn(email)
+	if err != nil {
+		log.Printf("c.tokensRepo.ThrottleMagicSignIn| %s magic signin failed: %v\n", email, err.Error())
+	}
+	if wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrMagicSignInThrottled)
+	}
+
+	accepted := func() error {
+		return ctx.
+			Status(http.StatusAccepted).
+			JSON(fiber.Map{
+				"message": magicSignInMessage,
+			})
+	}
+
+	user, err := c.usersRepo.GetByEmail(email)
+	if err != nil {
+		return accepted()
+	}
+	userId := user.Id.Hex()
+
+	if input.Method == magicMethodCode {
+		code, err := security.NewOneTimeCode()
+		if err == nil {
+			err = c.tokensRepo.CreateSignInCode(userId, user.Email, code)
+		}
+		if err != nil {
+			log.Printf("c.tokensRepo.CreateSignInCode| %s magic signin failed: %v\n", userId, err.Error())
+			return accepted()
+		}
+		sendMail(ctx, mail.KindSignInCode, user, mail.Data{"Code": code})
+		return accepted()
+	}
+
+	token, err := security.NewOpaqueToken()
+	if err == nil {
+		err = c.tokensRepo.CreateMagicLink(token, userId, user.Email)
+	}
+	if err != nil {
+		log.Printf("c.tokensRepo.CreateMagicLink| %s magic signin failed: %v\n", userId, err.Error())
+		return accepted()
+	}
+	link := withQuery(mail.MagicLinkURL, url.Values{"token": {token}})
+	sendMail(ctx, mail.KindMagicLink, user, mail.Data{"Link": link})
+	return accepted()
+}
+
+// VerifyMagicSignIn Handler Function signs in with the token of a sign in link, or with an
+// address and the code emailed to it. Either works once; a code also stops working after a
+// few wrong guesses, which count as failed sign ins too. Users with a second factor are
+// answered with an MFA challenge instead.
+// @Summary Complete Passwordless Sign In
+// @Description Sign in with a sign in link token, or an email and sign in code
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body models.MagicSignInVerifyInput true "Link token, or email and code"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/signin/magic/verify [post]
+func (c *authController) VerifyMagicSignIn(ctx *fiber.Ctx) error {
+	var input models.MagicSignInVerifyInput
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	// Signing in proves the email reached its owner, so it only counts while
+	// the account still has the address it was sent to
+	var user *models.User
+	switch {
+	case input.Token != "":
+		userId, email, err := c.tokensRepo.ConsumeMagicLink(input.Token)
+		if err == nil {
+			user, err = c.usersRepo.GetById(userId)
+		}
+		if err != nil || user.Email != email {
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(util.ErrInvalidMagicLink))
+		}
+	case input.Email != "" && input.Code != "":
+		// Codes are guessed like passwords, so they fail like passwords
+		email := util.NormalizeEmail(input.Email)
+		if wait := c.signInWait(ctx, email); wait > 0 {
+			return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+		}
+		user, err = c.usersRepo.GetByEmail(email)
+		sentTo := ""
+		if err == nil {
+			sentTo, err = c.tokensRepo.UseSignInCode(user.Id.Hex(), strings.TrimSpace(input.Code))
+		}
+		if err != nil || sentTo != user.Email {
+			c.failSignIn(ctx, email)
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(util.ErrInvalidSignInCode))
+		}
+	default:
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrMissingMagicSignInSecret))
+	}
+
+	// The email just reached its owner, which is all verifying it proves
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now()
+		err = c.usersRepo.Update(user)
+		if err != nil {
+			log.Printf("c.usersRepo.Update| %s magic signin failed: %v\n", user.Id.Hex(), err.Error())
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+		log.Printf("Email of user %s was verified\n", user.Id.Hex())
+	}
+
+	return c.continueSignIn(ctx, user)
+}
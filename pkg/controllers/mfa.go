@@ -0,0 +1,465 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	mfaMethodTOTP         = "totp"
+	mfaMethodWebAuthn     = "webauthn"
+	mfaMethodRecoveryCode = "recovery_code"
+
+	// defaultServiceName names the service in authenticator apps and passkey
+	// prompts
+	defaultServiceName = "EfficientLife"
+	// totpQRSize is the width and height of the enrollment QR code in pixels
+	totpQRSize = 256
+)
+
+/********************************************************
+ *		Handler Functions for Multi-Factor Auth			*
+ ********************************************************/
+
+// SignInMFA Handler Function completes a sign in that was answered with an MFA challenge
+// @Summary Sign In with a second factor
+// @Description Answer the MFA challenge of a sign in with a TOTP or recovery code
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param challenge body models.MFACodeInput true "MFA challenge token and code"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Router /api/v1/signin/mfa [post]
+func (c *authController) SignInMFA(ctx *fiber.Ctx) error {
+	var input models.MFACodeInput
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	userId, err := c.tokensRepo.UseMFAChallenge(input.MFAToken)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(util.ErrInvalidMFAToken))
+	}
+	user, err := c.usersRepo.GetById(userId)
+	if err != nil {
+		log.Printf("c.usersRepo.GetById| %s mfa signin failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(util.ErrInvalidMFAToken))
+	}
+	if wait := c.signInWait(ctx, user.Email); wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+	}
+	err = c.verifySecondFactor(user, &input)
+	if err != nil {
+		log.Printf("c.verifySecondFactor| %s mfa signin failed: %v\n", userId, err.Error())
+		c.failSignIn(ctx, user.Email)
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.DeleteMFAChallenge(input.MFAToken)
+	if err != nil {
+		log.Printf("c.tokensRepo.DeleteMFAChallenge| %s mfa signin failed: %v\n", userId, err.Error())
+	}
+
+	return c.completeSignIn(ctx, user)
+}
+
+// EnrollTOTP Handler Function starts enrolling an authenticator app. The secret only takes
+// effect once a code generated from it is confirmed.
+// @Summary Enroll an authenticator
+// @Description Start TOTP enrollment and get the otpauth URI and its QR code as a PNG data URI
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} util.JError
+// @Failure 409 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/mfa/totp [post]
+func (c *authController) EnrollTOTP(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	if user.TOTPSecret != "" {
+		return ctx.
+			Status(http.StatusConflict).
+			JSON(util.NewJError(util.ErrMFAAlreadyEnabled))
+	}
+
+	secret, err := security.NewTOTPSecret()
+	if err == nil {
+		err = c.tokensRepo.CreateTOTPEnrollment(user.Id.Hex(), secret)
+	}
+	if err != nil {
+		log.Printf("c.tokensRepo.CreateTOTPEnrollment| %s enroll totp failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	uri := security.TOTPURI(totpIssuer(), user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, totpQRSize)
+	if err != nil {
+		log.Printf("qrcode.Encode| %s enroll totp failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"secret":      secret,
+			"otpauth_uri": uri,
+			"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+}
+
+// ConfirmTOTP Handler Function enables the authenticator being enrolled with a code it
+// generated, and returns the recovery codes unless the user has some already. They are
+// shown this once only.
+// @Summary Confirm an authenticator
+// @Description Confirm TOTP enrollment with a code and get recovery codes
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param code body string true "TOTP code"
+// @Success 200 {object} map[string][]string
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 409 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/mfa/totp/confirm [post]
+func (c *authController) ConfirmTOTP(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	var input models.MFACodeInput
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	if user.TOTPSecret != "" {
+		return ctx.
+			Status(http.StatusConflict).
+			JSON(util.NewJError(util.ErrMFAAlreadyEnabled))
+	}
+
+	secret, err := c.tokensRepo.RetrieveTOTPEnrollment(user.Id.Hex())
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrNoMFAEnrollment))
+	}
+	step, err := security.VerifyTOTP(secret, input.Code, time.Now())
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPLastStep = step
+	response := fiber.Map{}
+	// A passkey may have brought recovery codes already
+	if len(user.RecoveryCodes) == 0 {
+		response["recovery_codes"], err = c.resetRecoveryCodes(user)
+	} else {
+		user.UpdatedAt = time.Now()
+		err = c.usersRepo.UpdateMFA(user)
+	}
+	if err != nil {
+		log.Printf("c.usersRepo.UpdateMFA| %s confirm totp failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.DeleteTOTPEnrollment(user.Id.Hex())
+	if err != nil {
+		log.Printf("c.tokensRepo.DeleteTOTPEnrollment| %s confirm totp failed: %v\n", user.Id.Hex(), err.Error())
+	}
+
+	log.Printf("Enabled TOTP for user %s\n", user.Id.Hex())
+	return ctx.
+		Status(http.StatusOK).
+		JSON(response)
+}
+
+// DisableTOTP Handler Function removes the authenticator of the user, after proving a second
+// factor once more. The recovery codes go with it unless a passkey is left.
+// @Summary Disable the authenticator
+// @Description Disable TOTP with a TOTP or recovery code
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param code body models.MFACodeInput true "TOTP or recovery code"
+// @Success 204
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/mfa/totp [delete]
+func (c *authController) DisableTOTP(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	var input models.MFACodeInput
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	if user.TOTPSecret == "" {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrMFANotEnabled))
+	}
+	wait, err := c.proveSecondFactor(ctx, user, &input)
+	if wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+	}
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	if len(user.WebAuthnCredentials) == 0 {
+		user.RecoveryCodes = nil
+	}
+	user.UpdatedAt = time.Now()
+	err = c.usersRepo.UpdateMFA(user)
+	if err != nil {
+		log.Printf("c.usersRepo.UpdateMFA| %s disable totp failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	log.Printf("Disabled TOTP for user %s\n", user.Id.Hex())
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes Handler Function replaces every recovery code of the user, after
+// proving a second factor
+// @Summary Regenerate recovery codes
+// @Description Replace the recovery codes with new ones
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param code body models.MFACodeInput true "TOTP or recovery code"
+// @Success 200 {object} map[string][]string
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/mfa/recovery-codes [post]
+func (c *authController) RegenerateRecoveryCodes(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	var input models.MFACodeInput
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	if !user.MFAEnabled() {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrMFANotEnabled))
+	}
+	wait, err := c.proveSecondFactor(ctx, user, &input)
+	if wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+	}
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+	// Reload the user, so a TOTP step or recovery code just used isn't
+	// written back
+	user, err = c.usersRepo.GetById(user.Id.Hex())
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	codes, err := c.resetRecoveryCodes(user)
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"recovery_codes": codes,
+		})
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// authUser loads the user making an authenticated request
+func (c *authController) authUser(ctx *fiber.Ctx) (*models.User, int, error) {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	user, err := c.usersRepo.GetById(userId)
+	if err != nil {
+		return nil, http.StatusUnauthorized, util.ErrUnauthorized
+	}
+	return user, 0, nil
+}
+
+// proveSecondFactor checks a second factor proven once more by a signed in
+// user. A stolen session must not be able to guess it, so attempts are
+// throttled and failures counted like failed sign ins, locking the account
+// when they pile up. It returns how long to wait instead while throttled.
+func (c *authController) proveSecondFactor(ctx *fiber.Ctx, user *models.User, input *models.MFACodeInput) (time.Duration, error) {
+	if wait := c.signInWait(ctx, user.Email); wait > 0 {
+		return wait, util.ErrSignInThrottled
+	}
+	err := c.verifySecondFactor(user, input)
+	if err != nil {
+		log.Printf("c.verifySecondFactor| %s prove second factor failed: %v\n", user.Id.Hex(), err.Error())
+		c.failSignIn(ctx, user.Email)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// verifySecondFactor checks a TOTP or recovery code of the user and uses it
+// up, so neither can be replayed. A passkey assertion answers a
+// reauthentication ceremony, which is used up the same way.
+func (c *authController) verifySecondFactor(user *models.User, input *models.MFACodeInput) error {
+	if !user.MFAEnabled() {
+		return util.ErrMFANotEnabled
+	}
+	userId := user.Id.Hex()
+
+	if input.Assertion != nil && len(user.WebAuthnCredentials) > 0 {
+		return c.verifyReauthentication(user, input.Assertion)
+	}
+
+	if input.Code != "" && user.TOTPSecret != "" {
+		step, err := security.VerifyTOTP(user.TOTPSecret, input.Code, time.Now())
+		if err != nil {
+			return err
+		}
+		ok, err := c.usersRepo.UseTOTPStep(userId, step)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return util.ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	if input.RecoveryCode != "" {
+		// Codes are random enough to be stored like tokens and looked up by hash
+		hash := security.HashToken(security.NormalizeRecoveryCode(input.RecoveryCode))
+		ok, err := c.usersRepo.UseRecoveryCode(userId, hash)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Printf("User %s used a recovery code, %d left\n", userId, len(user.RecoveryCodes)-1)
+			return nil
+		}
+	}
+	return util.ErrInvalidMFACode
+}
+
+// mfaMethods lists the second factors the user can answer an MFA challenge with
+func mfaMethods(user *models.User) []string {
+	methods := []string{}
+	if user.TOTPSecret != "" {
+		methods = append(methods, mfaMethodTOTP)
+	}
+	if len(user.WebAuthnCredentials) > 0 && security.WebAuthn != nil {
+		methods = append(methods, mfaMethodWebAuthn)
+	}
+	if len(user.RecoveryCodes) > 0 {
+		methods = append(methods, mfaMethodRecoveryCode)
+	}
+	return methods
+}
+
+// resetRecoveryCodes gives the user new recovery codes, stores their hashes
+// together with the rest of the user's second factors and returns them
+func (c *authController) resetRecoveryCodes(user *models.User) ([]string, error) {
+	codes, err := security.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = security.HashToken(code)
+	}
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = time.Now()
+	err = c.usersRepo.UpdateMFA(user)
+	if err != nil {
+		log.Printf("c.usersRepo.UpdateMFA| %s recovery codes failed: %v\n", user.Id.Hex(), err.Error())
+		return nil, err
+	}
+	return codes, nil
+}
+
+// totpIssuer names the service in authenticator apps, TOTP_ISSUER when set
+func totpIssuer() string {
+	if security.TOTPIssuer != "" {
+		return security.TOTPIssuer
+	}
+	return defaultServiceName
+}
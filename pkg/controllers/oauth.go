@@ -0,0 +1,965 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/repository"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	grantTypeAuthorizationCode = "authorization_code"
+	grantTypeRefreshToken      = "refresh_token"
+	grantTypeClientCredentials = "client_credentials"
+	responseTypeCode           = "code"
+)
+
+// OAuthController defines the contract for the OAuth 2.0 authorization server
+type OAuthController interface {
+	RegisterClient(ctx *fiber.Ctx) error
+	GetClients(ctx *fiber.Ctx) error
+	DeleteClient(ctx *fiber.Ctx) error
+	UpdateClientAccess(ctx *fiber.Ctx) error
+	Authorize(ctx *fiber.Ctx) error
+	Consent(ctx *fiber.Ctx) error
+	Token(ctx *fiber.Ctx) error
+	Introspect(ctx *fiber.Ctx) error
+	Revoke(ctx *fiber.Ctx) error
+	Discovery(ctx *fiber.Ctx) error
+	UserInfo(ctx *fiber.Ctx) error
+}
+
+// oauthController implements OAuthController
+type oauthController struct {
+	usersRepo   repository.UsersRepository
+	clientsRepo repository.ClientsRepository
+	tokensRepo  repository.TokenRepository
+	auditRepo   repository.AuditRepository
+}
+
+const auditClientAccess = "clients.access"
+
+// NewOAuthController constructs a new instance of OAuthController with given repository dependencies
+func NewOAuthController(repos map[string]interface{}) OAuthController {
+	return &oauthController{
+		usersRepo:   repos["users"].(repository.UsersRepository),
+		clientsRepo: repos["clients"].(repository.ClientsRepository),
+		tokensRepo:  repos["tokens"].(repository.TokenRepository),
+		auditRepo:   repos["audit"].(repository.AuditRepository),
+	}
+}
+
+// authorizeRequest holds the parameters of an authorization request, read from
+// the query string on the prompt and from the body on the consent decision
+type authorizeRequest struct {
+	ResponseType        string `query:"response_type" form:"response_type" json:"response_type"`
+	ClientId            string `query:"client_id" form:"client_id" json:"client_id"`
+	RedirectURI         string `query:"redirect_uri" form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `query:"scope" form:"scope" json:"scope"`
+	State               string `query:"state" form:"state" json:"state"`
+	CodeChallenge       string `query:"code_challenge" form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" form:"code_challenge_method" json:"code_challenge_method"`
+	Nonce               string `query:"nonce" form:"nonce" json:"nonce"`
+	Approve             bool   `form:"approve" json:"approve"`
+
+	// redirectTo is where the user is sent back to, RedirectURI or the
+	// client's only registered URI when the request named none
+	redirectTo string
+}
+
+// tokenRequest holds the parameters accepted by the token endpoint
+type tokenRequest struct {
+	GrantType    string `form:"grant_type" json:"grant_type"`
+	Code         string `form:"code" json:"code"`
+	RedirectURI  string `form:"redirect_uri" json:"redirect_uri"`
+	ClientId     string `form:"client_id" json:"client_id"`
+	CodeVerifier string `form:"code_verifier" json:"code_verifier"`
+	RefreshToken string `form:"refresh_token" json:"refresh_token"`
+	ClientSecret string `form:"client_secret" json:"client_secret"`
+	Scope        string `form:"scope" json:"scope"`
+}
+
+// registeredClient is returned once on registration, the only time the
+// plain client secret is ever shown
+type registeredClient struct {
+	*models.Client
+	Secret string `json:"client_secret,omitempty"`
+}
+
+/********************************************************
+ *			Handler Functions for OAuth Clients			*
+ ********************************************************/
+
+// RegisterClient registers a new OAuth client owned by the caller. Confidential clients
+// receive a client secret in the response, which is not retrievable afterwards.
+// @Summary Register an OAuth client
+// @Description Register an OAuth client
+// @Tags OAuth
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param name body string true "Client name"
+// @Param redirect_uris body []string false "Allowed redirect URIs, required for public clients"
+// @Param confidential body bool false "Issue a client secret"
+// @Success 201 {object} models.Client
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Router /oauth/clients [post]
+func (c *oauthController) RegisterClient(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var client models.Client
+	err = ctx.BodyParser(&client)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	// What a client may do on its own behalf is up to an administrator
+	if len(client.Scopes) > 0 || client.ResourceServer {
+		return ctx.
+			Status(http.StatusForbidden).
+			JSON(util.NewJError(util.ErrPrivilegedClientField))
+	}
+	client.Scopes = []string{}
+
+	err = verifyClient(&client)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	client.Id = primitive.NewObjectID().Hex()
+	client.Owner = userId
+	client.CreatedAt = time.Now()
+	client.UpdatedAt = client.CreatedAt
+
+	var secret string
+	if client.Confidential {
+		secret, err = security.NewOpaqueToken()
+		if err != nil {
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+		client.SecretHash, err = security.EncryptPassword(secret)
+		if err != nil {
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+	}
+
+	err = c.clientsRepo.Save(&client)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	return ctx.
+		Status(http.StatusCreated).
+		JSON(registeredClient{&client, secret})
+}
+
+// GetClients returns the OAuth clients owned by the caller
+// @Summary List own OAuth clients
+// @Description List own OAuth clients
+// @Tags OAuth
+// @Accept */*
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {array} models.Client
+// @Failure 401 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /oauth/clients [get]
+func (c *oauthController) GetClients(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	clients, err := c.clientsRepo.GetByOwner(userId)
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(clients)
+}
+
+// DeleteClient deletes an OAuth client owned by the caller
+// @Summary Delete an OAuth client
+// @Description Delete an OAuth client
+// @Tags OAuth
+// @Accept */*
+// @Produce json
+// @Param id path string true "Client ID"
+// @Param Authorization header string true "specific user token"
+// @Success 204
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /oauth/clients/{id} [delete]
+func (c *oauthController) DeleteClient(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	client, err := c.clientsRepo.GetById(ctx.Params("id"))
+	if err != nil || client.Owner != userId {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrInvalidClient))
+	}
+	err = c.clientsRepo.Delete(client.Id)
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	ctx.Set("Entity", client.Id)
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// UpdateClientAccess sets the scopes a client may request with the client credentials grant
+// and whether it is a resource server, allowed to introspect tokens issued to anyone
+// @Summary Grant access to an OAuth client
+// @Description Set the scopes a confidential client may request for itself and whether it may introspect every token (clients:write)
+// @Tags OAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Client ID"
+// @Param scopes body []string true "Scopes allowed for the client credentials grant"
+// @Param resource_server body bool false "Allow introspecting tokens issued to other clients"
+// @Param Authorization header string true "specific user token"
+// @Success 200 {object} models.Client
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Router /oauth/clients/{id}/access [put]
+func (c *oauthController) UpdateClientAccess(ctx *fiber.Ctx) error {
+	actorId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var input struct {
+		Scopes         []string `json:"scopes"`
+		ResourceServer bool     `json:"resource_server"`
+	}
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	err = verifyScopes(input.Scopes)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	client, err := c.clientsRepo.GetById(ctx.Params("id"))
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrInvalidClient))
+	}
+	client.Scopes = input.Scopes
+	if client.Scopes == nil {
+		client.Scopes = []string{}
+	}
+	client.ResourceServer = input.ResourceServer
+	client.UpdatedAt = time.Now()
+	err = c.clientsRepo.UpdateAccess(client)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	recordAudit(ctx, c.auditRepo, actorId, auditClientAccess, client.Id)
+	return ctx.
+		Status(http.StatusOK).
+		JSON(client)
+}
+
+/********************************************************
+ *		Handler Functions for the Authorization Flow	*
+ ********************************************************/
+
+// Authorize validates an authorization request and returns what the signed in user is
+// asked to consent to
+// @Summary OAuth authorization request
+// @Description Validates an authorization code request (PKCE required) and returns the consent prompt
+// @Tags OAuth
+// @Accept */*
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param response_type query string true "Must be code"
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string false "Registered redirect URI"
+// @Param scope query string false "Requested scope"
+// @Param state query string false "Opaque client state"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string false "S256 or plain"
+// @Param nonce query string false "OpenID Connect nonce"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} util.OAuthError
+// @Failure 401 {object} util.JError
+// @Router /oauth/authorize [get]
+func (c *oauthController) Authorize(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var req authorizeRequest
+	err = ctx.QueryParser(&req)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthInvalidRequest, err))
+	}
+
+	client, code, err := c.verifyAuthorizeRequest(&req)
+	if err != nil {
+		log.Printf("verifyAuthorizeRequest| %s authorize failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(code, err))
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"client": fiber.Map{
+				"client_id": client.Id,
+				"name":      client.Name,
+			},
+			"redirect_uri":          req.RedirectURI,
+			"scope":                 req.Scope,
+			"state":                 req.State,
+			"code_challenge":        req.CodeChallenge,
+			"code_challenge_method": req.CodeChallengeMethod,
+			"nonce":                 req.Nonce,
+		})
+}
+
+// Consent records the user's decision on an authorization request and returns the
+// redirect URI carrying either the authorization code or an access_denied error
+// @Summary OAuth consent decision
+// @Description Approve or deny an authorization request
+// @Tags OAuth
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param approve body bool true "Whether the user approves the request"
+// @Param response_type body string true "Must be code"
+// @Param client_id body string true "Client ID"
+// @Param redirect_uri body string false "Registered redirect URI"
+// @Param scope body string false "Requested scope"
+// @Param state body string false "Opaque client state"
+// @Param code_challenge body string true "PKCE code challenge"
+// @Param code_challenge_method body string false "S256 or plain"
+// @Param nonce body string false "OpenID Connect nonce"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} util.OAuthError
+// @Failure 401 {object} util.JError
+// @Router /oauth/authorize [post]
+func (c *oauthController) Consent(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var req authorizeRequest
+	err = ctx.BodyParser(&req)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewOAuthError(util.OAuthInvalidRequest, err))
+	}
+
+	_, code, err := c.verifyAuthorizeRequest(&req)
+	if err != nil {
+		log.Printf("verifyAuthorizeRequest| %s consent failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(code, err))
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if !req.Approve {
+		params.Set("error", util.OAuthAccessDenied)
+		params.Set("error_description", util.ErrAccessDenied.Error())
+		return ctx.
+			Status(http.StatusOK).
+			JSON(fiber.Map{
+				"redirect_to": withQuery(req.redirectTo, params),
+			})
+	}
+
+	authCode, err := security.NewOpaqueToken()
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.CreateCode(authCode, &models.AuthorizationCode{
+		ClientId:            req.ClientId,
+		User:                userId,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Nonce:               req.Nonce,
+	})
+	if err != nil {
+		log.Printf("c.tokensRepo.CreateCode| %s consent failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	params.Set("code", authCode)
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"redirect_to": withQuery(req.redirectTo, params),
+		})
+}
+
+// Token exchanges an authorization code or a refresh token for a new token pair
+// @Summary OAuth token endpoint
+// @Description Supports the authorization_code (with PKCE), refresh_token and client_credentials
+// @Description grants. Confidential clients authenticate with HTTP Basic or client_secret. An ID
+// @Description token is included when the openid scope was granted.
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code, refresh_token or client_credentials"
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret for confidential clients"
+// @Param scope formData string false "Requested scope for client_credentials"
+// @Param code formData string false "Authorization code"
+// @Param redirect_uri formData string false "Redirect URI used in the authorization request"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Param refresh_token formData string false "Refresh token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} util.OAuthError
+// @Failure 401 {object} util.OAuthError
+// @Router /oauth/token [post]
+func (c *oauthController) Token(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Set(fiber.HeaderPragma, "no-cache")
+
+	var req tokenRequest
+	err := ctx.BodyParser(&req)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthInvalidRequest, err))
+	}
+
+	client, err := c.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		log.Printf("c.authenticateClient| %s token failed: %v\n", req.ClientId, err.Error())
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewOAuthError(util.OAuthInvalidClient, util.ErrInvalidClient))
+	}
+
+	var grant models.RefreshToken
+	var nonce string
+	switch req.GrantType {
+	case grantTypeAuthorizationCode:
+		code, err := c.tokensRepo.ConsumeCode(req.Code)
+		if err != nil {
+			log.Printf("c.tokensRepo.ConsumeCode| %s token failed: %v\n", client.Id, err.Error())
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewOAuthError(util.OAuthInvalidGrant, util.ErrInvalidGrant))
+		}
+		// The redirect URI has to be repeated only when the authorization
+		// request named one (RFC 6749 section 4.1.3)
+		if code.ClientId != client.Id || (code.RedirectURI != "" && code.RedirectURI != req.RedirectURI) {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewOAuthError(util.OAuthInvalidGrant, util.ErrInvalidGrant))
+		}
+		if !security.VerifyCodeChallenge(req.CodeVerifier, code.CodeChallenge, code.CodeChallengeMethod) {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewOAuthError(util.OAuthInvalidGrant, util.ErrInvalidCodeVerifier))
+		}
+		grant = models.RefreshToken{
+			User:     code.User,
+			ClientId: code.ClientId,
+			Scope:    code.Scope,
+		}
+		nonce = code.Nonce
+
+	case grantTypeRefreshToken:
+		refresh, err := c.tokensRepo.UseRefresh(req.RefreshToken)
+		if err == util.ErrRefreshTokenReused {
+			log.Printf("c.tokensRepo.UseRefresh| %s refresh token reused, revoking family %s\n", refresh.User, refresh.Family)
+			if err := c.tokensRepo.RevokeFamily(refresh.Family); err != nil {
+				log.Printf("c.tokensRepo.RevokeFamily| %s revoke failed: %v\n", refresh.User, err.Error())
+			}
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewOAuthError(util.OAuthInvalidGrant, util.ErrRefreshTokenReused))
+		}
+		if err != nil || refresh.ClientId != client.Id {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewOAuthError(util.OAuthInvalidGrant, util.ErrInvalidRefreshToken))
+		}
+		grant = *refresh
+
+	case grantTypeClientCredentials:
+		return c.clientCredentials(ctx, client, req.Scope)
+
+	default:
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthUnsupportedGrantType, util.ErrUnsupportedGrantType))
+	}
+
+	token, refreshToken, err := issueTokens(ctx, c.tokensRepo, grant)
+	if err != nil {
+		log.Printf("issueTokens| %s token failed: %v\n", client.Id, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	response := fiber.Map{
+		"access_token":  token,
+		"token_type":    "Bearer",
+		"expires_in":    int(security.AccessTokenLifetime.Seconds()),
+		"refresh_token": refreshToken,
+		"scope":         grant.Scope,
+	}
+
+	if hasScope(grant.Scope, scopeOpenID) && security.OIDCEnabled() {
+		idToken, err := c.newIDToken(grant, nonce)
+		if err != nil {
+			log.Printf("c.newIDToken| %s token failed: %v\n", client.Id, err.Error())
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+		response["id_token"] = idToken
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(response)
+}
+
+// Introspect reports whether a token is active and describes it (RFC 7662). Only
+// confidential clients may introspect tokens, and only resource servers may learn
+// about tokens issued to someone else: to any other client those are inactive.
+// @Summary OAuth token introspection
+// @Description Reports whether an access or refresh token is active. Requires client authentication; only resource servers see tokens issued to other clients.
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token to introspect"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret, unless sent with HTTP Basic"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} util.OAuthError
+// @Failure 401 {object} util.OAuthError
+// @Router /oauth/introspect [post]
+func (c *oauthController) Introspect(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+
+	var req struct {
+		Token         string `form:"token" json:"token"`
+		TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
+		ClientId      string `form:"client_id" json:"client_id"`
+		ClientSecret  string `form:"client_secret" json:"client_secret"`
+	}
+	err := ctx.BodyParser(&req)
+	if err != nil || req.Token == "" {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthInvalidRequest, err))
+	}
+
+	client, err := c.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil || !client.Confidential {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewOAuthError(util.OAuthInvalidClient, util.ErrInvalidClient))
+	}
+
+	// The hint only decides which kind of token is looked up first
+	lookups := []func(string) fiber.Map{c.introspectAccessToken, c.introspectRefreshToken}
+	if req.TokenTypeHint == grantTypeRefreshToken {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, lookup := range lookups {
+		if info := lookup(req.Token); info != nil {
+			if !client.ResourceServer && info["client_id"] != client.Id {
+				log.Printf("Refused introspection of a token of %v to client %s\n", info["client_id"], client.Id)
+				break
+			}
+			log.Printf("Introspected token for %s on behalf of client %s\n", info["sub"], client.Id)
+			return ctx.
+				Status(http.StatusOK).
+				JSON(info)
+		}
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"active": false,
+		})
+}
+
+// Revoke invalidates an access or refresh token issued to the calling client (RFC 7009).
+// Revoking a refresh token also revokes every token issued in the same grant. Unknown
+// tokens are not an error.
+// @Summary OAuth token revocation
+// @Description Revokes an access or refresh token issued to the calling client
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token to revoke"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret for confidential clients"
+// @Success 200
+// @Failure 400 {object} util.OAuthError
+// @Failure 401 {object} util.OAuthError
+// @Router /oauth/revoke [post]
+func (c *oauthController) Revoke(ctx *fiber.Ctx) error {
+	var req struct {
+		Token         string `form:"token" json:"token"`
+		TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
+		ClientId      string `form:"client_id" json:"client_id"`
+		ClientSecret  string `form:"client_secret" json:"client_secret"`
+	}
+	err := ctx.BodyParser(&req)
+	if err != nil || req.Token == "" {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthInvalidRequest, err))
+	}
+
+	client, err := c.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewOAuthError(util.OAuthInvalidClient, util.ErrInvalidClient))
+	}
+
+	if refresh, err := c.tokensRepo.RetrieveRefresh(req.Token); err == nil {
+		if refresh.ClientId == client.Id {
+			err = c.tokensRepo.RevokeFamily(refresh.Family)
+		}
+		if err != nil {
+			log.Printf("c.tokensRepo.RevokeFamily| %s revoke failed: %v\n", client.Id, err.Error())
+			return ctx.
+				Status(http.StatusServiceUnavailable).
+				JSON(util.NewJError(err))
+		}
+	} else if claims, err := security.ParseToken(req.Token); err == nil && claims.ClientId == client.Id {
+		err = c.tokensRepo.Delete(req.Token)
+		if err != nil {
+			log.Printf("c.tokensRepo.Delete| %s revoke failed: %v\n", client.Id, err.Error())
+			return ctx.
+				Status(http.StatusServiceUnavailable).
+				JSON(util.NewJError(err))
+		}
+	}
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// verifyClient validates a client registration
+func verifyClient(client *models.Client) error {
+	client.Name = strings.TrimSpace(client.Name)
+	if client.Name == "" {
+		return util.ErrEmptyName
+	}
+	// Service clients only use the client credentials grant and never redirect
+	if len(client.RedirectURIs) == 0 && !client.Confidential {
+		return util.ErrEmptyRedirectURIs
+	}
+	for _, uri := range client.RedirectURIs {
+		// Redirect URIs must be absolute and must not carry a fragment (RFC 6749 3.1.2)
+		parsed, err := url.Parse(uri)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Fragment != "" {
+			return util.ErrInvalidRedirectURI
+		}
+	}
+	return nil
+}
+
+// verifyScopes validates the scopes granted to a client, which have to be
+// valid scope tokens (RFC 6749 3.3)
+func verifyScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\"\\") {
+			return util.ErrInvalidScope
+		}
+	}
+	return nil
+}
+
+// verifyAuthorizeRequest checks an authorization request against the registered client
+// and fills in defaults. On failure it also returns the OAuth error code to report.
+func (c *oauthController) verifyAuthorizeRequest(req *authorizeRequest) (*models.Client, string, error) {
+	client, err := c.clientsRepo.GetById(req.ClientId)
+	if err != nil {
+		return nil, util.OAuthInvalidClient, util.ErrInvalidClient
+	}
+
+	req.redirectTo = req.RedirectURI
+	if req.redirectTo == "" && len(client.RedirectURIs) == 1 {
+		req.redirectTo = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		if uri == req.redirectTo {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return nil, util.OAuthInvalidRequest, util.ErrInvalidRedirectURI
+	}
+
+	if req.ResponseType != responseTypeCode {
+		return nil, util.OAuthUnsupportedResponseType, util.ErrUnsupportedResponseType
+	}
+
+	scopes := strings.Fields(req.Scope)
+	for _, scope := range scopes {
+		if !supportedScope(scope) {
+			return nil, util.OAuthInvalidScope, util.ErrInvalidScope
+		}
+	}
+	req.Scope = strings.Join(scopes, " ")
+
+	if req.CodeChallengeMethod == "" {
+		req.CodeChallengeMethod = security.PKCEMethodPlain
+	}
+	if req.CodeChallenge == "" ||
+		(req.CodeChallengeMethod != security.PKCEMethodS256 && req.CodeChallengeMethod != security.PKCEMethodPlain) {
+		return nil, util.OAuthInvalidRequest, util.ErrMissingCodeChallenge
+	}
+
+	return client, "", nil
+}
+
+// authenticateClient identifies the client calling the token endpoint. Confidential
+// clients must present their secret, either with HTTP Basic authentication
+// (client_secret_basic) or in the request body (client_secret_post).
+func (c *oauthController) authenticateClient(ctx *fiber.Ctx, id, secret string) (*models.Client, error) {
+	if basicId, basicSecret, ok := basicAuth(ctx); ok {
+		id, secret = basicId, basicSecret
+	}
+
+	client, err := c.clientsRepo.GetById(id)
+	if err != nil {
+		return nil, err
+	}
+	if client.Confidential {
+		if secret == "" {
+			return nil, util.ErrInvalidCredentials
+		}
+		err = security.VerifyPassword(client.SecretHash, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// clientCredentials issues an access token whose subject is the client itself,
+// marked as such so it can never be mistaken for a user id. No refresh token is
+// issued since the client can always authenticate again.
+func (c *oauthController) clientCredentials(ctx *fiber.Ctx, client *models.Client, requested string) error {
+	if !client.Confidential {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewOAuthError(util.OAuthUnauthorizedClient, util.ErrClientNotConfidential))
+	}
+
+	scope := strings.Join(client.Scopes, " ")
+	if requested != "" {
+		for _, s := range strings.Fields(requested) {
+			if !hasScope(scope, s) {
+				return ctx.
+					Status(http.StatusBadRequest).
+					JSON(util.NewOAuthError(util.OAuthInvalidScope, util.ErrInvalidScope))
+			}
+		}
+		scope = strings.Join(strings.Fields(requested), " ")
+	}
+
+	token, err := security.NewScopedToken(clientSubjectPrefix+client.Id, client.Id, scope, "")
+	if err != nil {
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.Create(token, clientSubjectPrefix+client.Id, true)
+	if err != nil {
+		log.Printf("c.tokensRepo.Create| %s client credentials failed: %v\n", client.Id, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(security.AccessTokenLifetime.Seconds()),
+			"scope":        scope,
+		})
+}
+
+// introspectAccessToken describes an access token whose signature is valid and which
+// has not been revoked, or returns nil
+func (c *oauthController) introspectAccessToken(token string) fiber.Map {
+	claims, err := security.ParseToken(token)
+	if err != nil {
+		return nil
+	}
+	// Tokens are dropped from the store on sign out and revocation
+	if subject, err := c.tokensRepo.Retrieve(token); err != nil || subject == "" {
+		return nil
+	}
+	return withoutEmpty(fiber.Map{
+		"active":     true,
+		"sub":        claims.Subject,
+		"client_id":  claims.ClientId,
+		"scope":      claims.Scope,
+		"exp":        claims.ExpiresAt,
+		"iat":        claims.IssuedAt,
+		"jti":        claims.Id,
+		"token_type": "Bearer",
+	})
+}
+
+// introspectRefreshToken describes a refresh token that has not been used yet, or
+// returns nil
+func (c *oauthController) introspectRefreshToken(token string) fiber.Map {
+	refresh, err := c.tokensRepo.RetrieveRefresh(token)
+	if err != nil || refresh.Uses > 0 {
+		return nil
+	}
+	return withoutEmpty(fiber.Map{
+		"active":     true,
+		"sub":        refresh.User,
+		"client_id":  refresh.ClientId,
+		"scope":      refresh.Scope,
+		"token_type": grantTypeRefreshToken,
+	})
+}
+
+// withoutEmpty drops the optional members of a response that have no value
+func withoutEmpty(m fiber.Map) fiber.Map {
+	for key, value := range m {
+		if value == "" {
+			delete(m, key)
+		}
+	}
+	return m
+}
+
+// basicAuth returns the client credentials sent with HTTP Basic authentication.
+// Both parts are form-encoded as required by RFC 6749 section 2.3.1.
+func basicAuth(ctx *fiber.Ctx) (string, string, bool) {
+	header := ctx.Get(fiber.HeaderAuthorization)
+	const prefix = "Basic "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	id, err = url.QueryUnescape(id)
+	if err != nil {
+		return "", "", false
+	}
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// withQuery appends params to the query string of uri
+func withQuery(uri string, params url.Values) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := parsed.Query()
+	for key, values := range params {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+
+	oauthInsufficientScope = "insufficient_scope"
+)
+
+// supportedScopes are the only scopes a user can grant to a client. Tokens
+// carrying them are good for nothing but the userinfo endpoint, so none of
+// them are offered while OpenID Connect is disabled.
+var supportedScopes = []string{scopeOpenID, scopeProfile, scopeEmail}
+
+/********************************************************
+ *		Handler Functions for OpenID Connect			*
+ ********************************************************/
+
+// Discovery serves the OpenID Connect provider metadata
+// @Summary OpenID Connect discovery
+// @Description OpenID Connect provider configuration
+// @Tags OIDC
+// @Accept */*
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} util.JError
+// @Router /.well-known/openid-configuration [get]
+func (c *oauthController) Discovery(ctx *fiber.Ctx) error {
+	if !security.OIDCEnabled() {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrOIDCDisabled))
+	}
+	issuer := security.Issuer
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/oauth/authorize",
+			"token_endpoint":                        issuer + "/oauth/token",
+			"introspection_endpoint":                issuer + "/oauth/introspect",
+			"revocation_endpoint":                   issuer + "/oauth/revoke",
+			"userinfo_endpoint":                     issuer + "/userinfo",
+			"jwks_uri":                              issuer + "/.well-known/jwks.json",
+			"scopes_supported":                      supportedScopes,
+			"response_types_supported":              []string{responseTypeCode},
+			"grant_types_supported":                 []string{grantTypeAuthorizationCode, grantTypeRefreshToken, grantTypeClientCredentials},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{security.JwtSigningMethod},
+			"token_endpoint_auth_methods_supported": []string{"none", "client_secret_basic", "client_secret_post"},
+			"code_challenge_methods_supported":      []string{security.PKCEMethodS256, security.PKCEMethodPlain},
+			"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "nonce", "name", "email", "email_verified"},
+		})
+}
+
+// UserInfo returns the claims about the user that the access token's scope allows
+// @Summary OpenID Connect userinfo
+// @Description Claims about the user the bearer token was issued for
+// @Tags OIDC
+// @Accept */*
+// @Produce json
+// @Param Authorization header string true "Bearer access token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.OAuthError
+// @Router /userinfo [get]
+func (c *oauthController) UserInfo(ctx *fiber.Ctx) error {
+	userId, claims, err := authClaims(ctx, c.tokensRepo)
+	if err != nil {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	if !hasScope(claims.Scope, scopeOpenID) {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope"`)
+		return ctx.
+			Status(http.StatusForbidden).
+			JSON(util.NewOAuthError(oauthInsufficientScope, util.ErrInsufficientScope))
+	}
+
+	user, err := c.usersRepo.GetById(userId)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(util.ErrUnauthorized))
+	}
+
+	info := userClaims(user, claims.Scope)
+	info.Subject = user.Id.Hex()
+	return ctx.
+		Status(http.StatusOK).
+		JSON(info)
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// newIDToken builds the ID token for a grant that includes the openid scope
+func (c *oauthController) newIDToken(grant models.RefreshToken, nonce string) (string, error) {
+	user, err := c.usersRepo.GetById(grant.User)
+	if err != nil {
+		return "", err
+	}
+	claims := userClaims(user, grant.Scope)
+	claims.Nonce = nonce
+	return security.NewIDToken(security.Issuer, user.Id.Hex(), grant.ClientId, claims)
+}
+
+// userClaims returns the standard claims about user released by scope
+func userClaims(user *models.User, scope string) security.IDClaims {
+	var claims security.IDClaims
+	if hasScope(scope, scopeProfile) {
+		claims.Name = user.Name
+	}
+	if hasScope(scope, scopeEmail) {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+// hasScope reports whether the space separated scope list contains want
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedScope reports whether scope may be requested by a client
+func supportedScope(scope string) bool {
+	if !security.OIDCEnabled() {
+		return false
+	}
+	for _, s := range supportedScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
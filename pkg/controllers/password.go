@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/mail"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// forgotPasswordMessage is answered to every reset request, so it can't tell
+// whether an account exists
+const forgotPasswordMessage = "If the address belongs to an account, a password reset link has been sent to it"
+
+/********************************************************
+ *			Handler Functions for Password Reset		*
+ ********************************************************/
+
+// ForgotPassword Handler Function sends a single use password reset link to the address
+// if it belongs to an account. The response is the same either way.
+// @Summary Forgot Password
+// @Description Request a password reset link
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param email body string true "Email"
+// @Success 202 {object} map[string]string
+// @Failure 422 {object} util.JError
+// @Router /api/v1/password/forgot [post]
+func (c *authController) ForgotPassword(ctx *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email" form:"email"`
+	}
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	accepted := func() error {
+		return ctx.
+			Status(http.StatusAccepted).
+			JSON(fiber.Map{
+				"message": forgotPasswordMessage,
+			})
+	}
+
+	token, err := security.NewOpaqueToken()
+	if err != nil {
+		log.Printf("security.NewOpaqueToken| forgot password failed: %v\n", err.Error())
+		return accepted()
+	}
+	user, err := c.usersRepo.GetByEmail(util.NormalizeEmail(input.Email))
+	if err != nil {
+		return accepted()
+	}
+	err = c.tokensRepo.CreateResetToken(token, user.Id.Hex())
+	if err != nil {
+		log.Printf("c.tokensRepo.CreateResetToken| %s forgot password failed: %v\n", user.Id.Hex(), err.Error())
+		return accepted()
+	}
+
+	link := withQuery(mail.PasswordResetURL, url.Values{"token": {token}})
+	sendMail(ctx, mail.KindPasswordReset, user, mail.Data{"Link": link})
+	return accepted()
+}
+
+// ResetPassword Handler Function sets a new password with a token from a reset link and
+// signs the user out everywhere
+// @Summary Reset Password
+// @Description Set a new password with a password reset token
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param token body string true "Password reset token"
+// @Param password body string true "New password"
+// @Success 204
+// @Failure 400 {object} util.VError
+// @Failure 422 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/password/reset [post]
+func (c *authController) ResetPassword(ctx *fiber.Ctx) error {
+	var input struct {
+		Token    string `json:"token" form:"token"`
+		Password string `json:"password" form:"password"`
+	}
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	// Check the new password before using up the token, so a password the
+	// policy refuses doesn't cost the user their reset link
+	userId, err := c.tokensRepo.RetrieveResetToken(input.Token)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidResetToken))
+	}
+	user, err := c.usersRepo.GetById(userId)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidResetToken))
+	}
+	err = security.CheckPassword(input.Password, user.Email, user.Name)
+	if err == nil {
+		err = security.SetPassword(user, input.Password)
+	}
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(errorBody(err))
+	}
+
+	consumed, err := c.tokensRepo.ConsumeResetToken(input.Token)
+	if err != nil || consumed != userId {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidResetToken))
+	}
+	user.UpdatedAt = time.Now()
+	err = c.usersRepo.Update(user)
+	if err != nil {
+		log.Printf("c.usersRepo.Update| %s reset password failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.RevokeUser(userId)
+	if err != nil {
+		log.Printf("c.tokensRepo.RevokeUser| %s reset password failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.RevokeResetTokens(userId)
+	if err != nil {
+		log.Printf("c.tokensRepo.RevokeResetTokens| %s reset password failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	log.Printf("Password of user %s was reset\n", userId)
+	return ctx.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/repository"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SessionController defines the interface for session controller
+type SessionController interface {
+	GetSessions(ctx *fiber.Ctx) error
+	DeleteSession(ctx *fiber.Ctx) error
+}
+
+// sessionController implements SessionController
+type sessionController struct {
+	tokensRepo repository.TokenRepository
+}
+
+// NewSessionController constructs a new instance of SessionController with given repository dependencies
+func NewSessionController(repos map[string]interface{}) SessionController {
+	return &sessionController{
+		tokensRepo: repos["tokens"].(repository.TokenRepository),
+	}
+}
+
+/********************************************************
+ *			Handler Functions for Sessions				*
+ ********************************************************/
+
+// GetSessions lists the active sessions of the authenticated user
+// @Summary List sessions
+// @Description List the active sessions of the authenticated user, most recently used first
+// @Tags Sessions
+// @Accept */*
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {array} models.Session
+// @Failure 401 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/sessions [get]
+func (c *sessionController) GetSessions(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	sessions, err := c.tokensRepo.GetSessions(userId)
+	if err != nil {
+		log.Printf("c.tokensRepo.GetSessions| %s failed: %v\n", userId, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	if claims, err := security.ParseToken(authToken(ctx)); err == nil {
+		for _, session := range sessions {
+			session.Current = session.Id == claims.Session
+		}
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(sessions)
+}
+
+// DeleteSession revokes one of the authenticated user's sessions
+// @Summary Revoke a session
+// @Description Revoke a session and every token issued in it
+// @Tags Sessions
+// @Accept */*
+// @Produce json
+// @Param id path string true "Session ID"
+// @Param Authorization header string true "specific user token"
+// @Success 204
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/sessions/{id} [delete]
+func (c *sessionController) DeleteSession(ctx *fiber.Ctx) error {
+	userId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	session, err := c.tokensRepo.GetSession(ctx.Params("id"))
+	if err != nil || session.User != userId {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrSessionNotFound))
+	}
+
+	err = c.tokensRepo.RevokeFamily(session.Id)
+	if err != nil {
+		log.Printf("c.tokensRepo.RevokeFamily| %s session %s failed: %v\n", userId, session.Id, err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.SendStatus(http.StatusNoContent)
+}
@@ -6,7 +6,9 @@ import (
 	"github.com/mixedmachine/user-auth-server/pkg/security"
 	"github.com/mixedmachine/user-auth-server/pkg/util"
 
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,12 +22,15 @@ type UserController interface {
 	GetUsers(ctx *fiber.Ctx) error
 	PutUser(ctx *fiber.Ctx) error
 	DeleteUser(ctx *fiber.Ctx) error
+	PutRoles(ctx *fiber.Ctx) error
+	UnlockUser(ctx *fiber.Ctx) error
 }
 
 // userController implements UserController
 type userController struct {
 	usersRepo  repository.UsersRepository
 	tokensRepo repository.TokenRepository
+	auditRepo  repository.AuditRepository
 }
 
 // NewUserController constructs a new instance of UserController with given repository dependencies
@@ -33,9 +38,18 @@ func NewUserController(repos map[string]interface{}) UserController {
 	return &userController{
 		usersRepo:  repos["users"].(repository.UsersRepository),
 		tokensRepo: repos["tokens"].(repository.TokenRepository),
+		auditRepo:  repos["audit"].(repository.AuditRepository),
 	}
 }
 
+const (
+	auditUserRead   = "users.read"
+	auditUserUpdate = "users.update"
+	auditUserDelete = "users.delete"
+	auditUserRoles  = "users.roles"
+	auditUserUnlock = "users.unlock"
+)
+
 /********************************************************
  *				Handler Functions for Users				*
  ********************************************************/
@@ -48,42 +62,65 @@ func NewUserController(repos map[string]interface{}) UserController {
 // @Produce  json
 // @Param id path string true "User ID"
 // @Param Authorization header string true "specific user token"
-// @Success 200 {object} models.User
+// @Success 200 {object} models.PublicUser
 // @Failure 400 {object} util.JError
 // @Failure 401 {object} util.JError
-// @Failure 500 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 404 {object} util.JError
 // @Router /api/v1/users/{id} [get]
 func (c *userController) GetUser(ctx *fiber.Ctx) error {
-	userId, err := AuthRequest(ctx, c.tokensRepo)
+	actorId, userId, status, err := c.authorizeTarget(ctx, security.PermUsersRead)
 	if err != nil {
 		return ctx.
-			Status(http.StatusUnauthorized).
+			Status(status).
 			JSON(util.NewJError(err))
 	}
 	user, err := c.usersRepo.GetById(userId)
 	if err != nil {
 		return ctx.
-			Status(http.StatusInternalServerError).
+			Status(http.StatusNotFound).
 			JSON(util.NewJError(err))
 	}
+	c.audit(ctx, actorId, auditUserRead, userId)
 	return ctx.
 		Status(http.StatusOK).
-		JSON(user)
+		JSON(models.NewPublicUser(user))
 }
 
-// GetUsers returns all users
-// @Summary Get all users
-// @Description Get all users
+// GetUsers returns a page of users
+// @Summary List users
+// @Description List users a page at a time, optionally filtered. Pass the returned next cursor as after to get the following page.
 // @Tags users
 // @Accept  json
 // @Produce  json
-// @Success 200 {array} models.User
+// @Param Authorization header string true "specific user token"
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Param after query string false "Cursor of the page to return"
+// @Param sort query string false "created_at, email or name, prefixed with - for descending order" default(created_at)
+// @Param email query string false "Email prefix"
+// @Param name query string false "Name"
+// @Param admin query bool false "Admin flag"
+// @Param created_after query string false "Created at or after, RFC 3339"
+// @Param created_before query string false "Created before, RFC 3339"
+// @Success 200 {object} object{users=[]models.PublicUser,next=string}
 // @Failure 400 {object} util.JError
 // @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
 // @Failure 500 {object} util.JError
 // @Router /api/v1/users [get]
 func (c *userController) GetUsers(ctx *fiber.Ctx) error {
-	users, err := c.usersRepo.GetAll()
+	query, err := userQuery(ctx)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+	users, next, err := c.usersRepo.List(query)
+	if err == util.ErrInvalidCursor || err == util.ErrInvalidSort {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
 	if err != nil {
 		return ctx.
 			Status(http.StatusInternalServerError).
@@ -91,7 +128,10 @@ func (c *userController) GetUsers(ctx *fiber.Ctx) error {
 	}
 	return ctx.
 		Status(http.StatusOK).
-		JSON(users)
+		JSON(fiber.Map{
+			"users": models.NewPublicUsers(users),
+			"next":  next,
+		})
 }
 
 // PutUser updates a user by id
@@ -101,23 +141,22 @@ func (c *userController) GetUsers(ctx *fiber.Ctx) error {
 // @Accept  json
 // @Produce  json
 // @Param id path string true "User ID"
-// @Param email body string true "User email"
-// @Param name body string true "User name"
-// @Param password body string true "User password"
+// @Param user body models.UpdateUserInput true "Fields to change"
 // @Param Authorization header string true "specific user token"
-// @Success 200 {object} models.User
-// @Failure 400 {object} util.JError
+// @Success 200 {object} models.PublicUser
+// @Failure 400 {object} util.VError
 // @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
 // @Failure 422 {object} util.JError
 // @Router /api/v1/users/{id} [put]
 func (c *userController) PutUser(ctx *fiber.Ctx) error {
-	userId, err := AuthRequest(ctx, c.tokensRepo)
+	actorId, userId, status, err := c.authorizeTarget(ctx, security.PermUsersWrite)
 	if err != nil {
 		return ctx.
-			Status(http.StatusUnauthorized).
+			Status(status).
 			JSON(util.NewJError(err))
 	}
-	var update models.User
+	var update models.UpdateUserInput
 	err = ctx.BodyParser(&update)
 	if err != nil {
 		return ctx.
@@ -125,7 +164,7 @@ func (c *userController) PutUser(ctx *fiber.Ctx) error {
 			JSON(util.NewJError(err))
 	}
 	update.Email = util.NormalizeEmail(update.Email)
-	if !govalidator.IsEmail(update.Email) {
+	if update.Email != "" && !govalidator.IsEmail(update.Email) {
 		return ctx.
 			Status(http.StatusBadRequest).
 			JSON(util.NewJError(util.ErrInvalidEmail))
@@ -141,17 +180,24 @@ func (c *userController) PutUser(ctx *fiber.Ctx) error {
 		if update.Name != "" {
 			user.Name = update.Name
 		}
-		if update.Email != "" {
+		emailChanged := update.Email != "" && update.Email != user.Email
+		if emailChanged {
 			user.Email = update.Email
+			user.EmailVerified = false
 		}
 		if update.Password != "" {
-			update.Password, err = security.EncryptPassword(update.Password)
+			err = security.CheckPassword(update.Password, user.Email, user.Name)
+			if err != nil {
+				return ctx.
+					Status(http.StatusBadRequest).
+					JSON(errorBody(err))
+			}
+			err = security.SetPassword(user, update.Password)
 			if err != nil {
 				return ctx.
 					Status(http.StatusBadRequest).
-					JSON(util.NewJError(err))
+					JSON(errorBody(err))
 			}
-			user.Password = update.Password
 		}
 		user.UpdatedAt = time.Now()
 		err = c.usersRepo.Update(user)
@@ -160,9 +206,13 @@ func (c *userController) PutUser(ctx *fiber.Ctx) error {
 				Status(http.StatusUnprocessableEntity).
 				JSON(util.NewJError(err))
 		}
+		if emailChanged {
+			sendEmailVerification(ctx, c.tokensRepo, user)
+		}
+		c.audit(ctx, actorId, auditUserUpdate, userId)
 		return ctx.
 			Status(http.StatusOK).
-			JSON(user)
+			JSON(models.NewPublicUser(user))
 	}
 
 	if exists != nil {
@@ -185,13 +235,14 @@ func (c *userController) PutUser(ctx *fiber.Ctx) error {
 // @Success 204
 // @Failure 400 {object} util.JError
 // @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
 // @Failure 500 {object} util.JError
 // @Router /api/v1/users/{id} [delete]
 func (c *userController) DeleteUser(ctx *fiber.Ctx) error {
-	userId, err := AuthRequest(ctx, c.tokensRepo)
+	actorId, userId, status, err := c.authorizeTarget(ctx, security.PermUsersDelete)
 	if err != nil {
 		return ctx.
-			Status(http.StatusUnauthorized).
+			Status(status).
 			JSON(util.NewJError(err))
 	}
 	err = c.usersRepo.Delete(userId)
@@ -200,12 +251,207 @@ func (c *userController) DeleteUser(ctx *fiber.Ctx) error {
 			Status(http.StatusInternalServerError).
 			JSON(util.NewJError(err))
 	}
-	err = c.tokensRepo.Delete(string(ctx.Request().Header.Peek("Authorization")))
+	err = c.tokensRepo.RevokeUser(userId)
 	if err != nil {
 		return ctx.
 			Status(http.StatusInternalServerError).
 			JSON(util.NewJError(err))
 	}
+	if actorId == userId {
+		err = c.tokensRepo.Delete(authToken(ctx))
+		if err != nil {
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+	}
+	c.audit(ctx, actorId, auditUserDelete, userId)
 	ctx.Set("Entity", userId)
 	return ctx.SendStatus(http.StatusNoContent)
 }
+
+// PutRoles replaces the roles and direct permissions of a user by id
+// @Summary Set the roles of a user by id
+// @Description Replace the roles and directly granted permissions of a user
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Param id path string true "User ID"
+// @Param roles body []string true "Roles"
+// @Param permissions body []string false "Permissions granted in addition to the roles"
+// @Param Authorization header string true "specific user token"
+// @Success 200 {object} models.PublicUser
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Router /api/v1/users/{id}/roles [put]
+func (c *userController) PutRoles(ctx *fiber.Ctx) error {
+	actorId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	var input struct {
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	for _, role := range input.Roles {
+		if !security.ValidRole(role) {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewJError(util.ErrUnknownRole))
+		}
+	}
+	for _, perm := range input.Permissions {
+		if !security.ValidPermission(perm) {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewJError(util.ErrUnknownPermission))
+		}
+	}
+
+	user, err := c.usersRepo.GetById(ctx.Params("id"))
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	user.Roles = input.Roles
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	user.Permissions = input.Permissions
+	user.Admin = security.HasRole(user.Roles, security.RoleAdmin)
+	user.UpdatedAt = time.Now()
+	err = c.usersRepo.UpdateRoles(user)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	c.audit(ctx, actorId, auditUserRoles, user.Id.Hex())
+	return ctx.
+		Status(http.StatusOK).
+		JSON(models.NewPublicUser(user))
+}
+
+// UnlockUser lifts the sign in lockout of a user by id and forgets their failed attempts
+// @Summary Unlock a user by id
+// @Description Lift the sign in delay or lockout that failed attempts put on a user
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Param id path string true "User ID"
+// @Param Authorization header string true "specific user token"
+// @Success 204
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/users/{id}/lockout [delete]
+func (c *userController) UnlockUser(ctx *fiber.Ctx) error {
+	actorId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	user, err := c.usersRepo.GetById(ctx.Params("id"))
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	err = c.tokensRepo.ClearLoginFailures(user.Email)
+	if err != nil {
+		log.Printf("c.tokensRepo.ClearLoginFailures| %s unlock user failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	c.audit(ctx, actorId, auditUserUnlock, user.Id.Hex())
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// authorizeTarget resolves the user a request acts on from the :id parameter.
+// Users may always act on themselves; acting on anyone else needs perm. It
+// returns the caller's id, the target's id and, on failure, the status to answer.
+func (c *userController) authorizeTarget(ctx *fiber.Ctx, perm security.Permission) (string, string, int, error) {
+	actorId, err := AuthRequest(ctx, c.tokensRepo)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+	targetId := ctx.Params("id")
+	if targetId == actorId {
+		return actorId, targetId, 0, nil
+	}
+
+	actor, err := c.usersRepo.GetById(actorId)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, util.ErrUnauthorized
+	}
+	if !security.HasPermission(actor, perm) {
+		return "", "", http.StatusForbidden, util.ErrForbidden
+	}
+	return actorId, targetId, 0, nil
+}
+
+// userQuery builds the user listing query from the request's query string
+func userQuery(ctx *fiber.Ctx) (*repository.UserQuery, error) {
+	query := &repository.UserQuery{
+		After:       ctx.Query("after"),
+		Sort:        ctx.Query("sort"),
+		EmailPrefix: ctx.Query("email"),
+		Name:        ctx.Query("name"),
+	}
+	var err error
+	if limit := ctx.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return nil, util.ErrInvalidQuery
+		}
+	}
+	if admin := ctx.Query("admin"); admin != "" {
+		value, err := strconv.ParseBool(admin)
+		if err != nil {
+			return nil, util.ErrInvalidQuery
+		}
+		query.Admin = &value
+	}
+	if after := ctx.Query("created_after"); after != "" {
+		query.CreatedAfter, err = time.Parse(time.RFC3339, after)
+		if err != nil {
+			return nil, util.ErrInvalidQuery
+		}
+	}
+	if before := ctx.Query("created_before"); before != "" {
+		query.CreatedBefore, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			return nil, util.ErrInvalidQuery
+		}
+	}
+	return query, nil
+}
+
+// audit records an action the caller performed on another user's account
+func (c *userController) audit(ctx *fiber.Ctx, actorId, action, targetId string) {
+	if actorId == targetId {
+		return
+	}
+	recordAudit(ctx, c.auditRepo, actorId, action, targetId)
+}
@@ -0,0 +1,674 @@
+package controllers
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// webauthnCredentialType is the only credential type WebAuthn defines
+	webauthnCredentialType = "public-key"
+
+	userVerificationRequired  = "required"
+	userVerificationPreferred = "preferred"
+)
+
+/********************************************************
+ *			Handler Functions for WebAuthn				*
+ ********************************************************/
+
+// BeginWebAuthnRegistration Handler Function starts registering a passkey or security key
+// for the signed in user
+// @Summary Begin passkey registration
+// @Description Get the options for navigator.credentials.create()
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/webauthn/register/begin [post]
+func (c *authController) BeginWebAuthnRegistration(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	rp, err := relyingParty()
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	challenge, err := c.newWebAuthnSession(user.Id.Hex(), models.WebAuthnRegistration)
+	if err != nil {
+		log.Printf("c.newWebAuthnSession| %s begin registration failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+
+	params := make([]fiber.Map, 0, len(security.COSEAlgorithms))
+	for _, alg := range security.COSEAlgorithms {
+		params = append(params, fiber.Map{"type": webauthnCredentialType, "alg": alg})
+	}
+	name := rp.Name
+	if name == "" {
+		name = defaultServiceName
+	}
+
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"challenge": challenge,
+			"rp": fiber.Map{
+				"id":   rp.Id,
+				"name": name,
+			},
+			"user": fiber.Map{
+				"id":          b64url(user.Id[:]),
+				"name":        user.Email,
+				"displayName": user.Name,
+			},
+			"pubKeyCredParams":   params,
+			"timeout":            security.WebAuthnTimeout.Milliseconds(),
+			"excludeCredentials": credentialDescriptors(user),
+			"authenticatorSelection": fiber.Map{
+				"residentKey":      "preferred",
+				"userVerification": userVerificationPreferred,
+			},
+			"attestation": security.WebAuthnAttestation,
+		})
+}
+
+// FinishWebAuthnRegistration Handler Function verifies the attestation of a new credential
+// and registers it. Users with a second factor have to prove it once more, so a stolen
+// session can't add one. The first second factor of a user comes with recovery codes.
+// @Summary Finish passkey registration
+// @Description Register the credential returned by navigator.credentials.create()
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param credential body models.WebAuthnCredentialInput true "Public key credential, with a TOTP code, recovery code or passkey assertion once a second factor is enabled"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 409 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/webauthn/register/finish [post]
+func (c *authController) FinishWebAuthnRegistration(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	var input models.WebAuthnCredentialInput
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	if user.MFAEnabled() {
+		wait, err := c.proveSecondFactor(ctx, user, &models.MFACodeInput{
+			Code:         input.Code,
+			RecoveryCode: input.RecoveryCode,
+			Assertion:    input.Assertion,
+		})
+		if wait > 0 {
+			return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+		}
+		if err != nil {
+			return ctx.
+				Status(http.StatusBadRequest).
+				JSON(util.NewJError(err))
+		}
+	}
+
+	clientDataJSON, _, err := c.useWebAuthnSession(&input, security.WebAuthnCreate, rp, models.WebAuthnRegistration, user.Id.Hex())
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+	attestationObject, err := unb64url(input.Response.AttestationObject)
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrInvalidWebAuthn))
+	}
+	authData, format, err := security.VerifyAttestation(attestationObject, clientDataJSON, rp)
+	if err != nil {
+		log.Printf("security.VerifyAttestation| %s finish registration failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	credentialId := b64url(authData.CredentialId)
+	if _, err = c.usersRepo.GetByWebAuthnCredential(credentialId); err != mongo.ErrNoDocuments {
+		return ctx.
+			Status(http.StatusConflict).
+			JSON(util.NewJError(util.ErrWebAuthnCredentialExists))
+	}
+	alg, _ := security.COSEKeyAlgorithm(authData.PublicKey)
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	now := time.Now()
+	credential := &models.WebAuthnCredential{
+		Id:          credentialId,
+		Name:        name,
+		PublicKey:   authData.PublicKey,
+		Algorithm:   alg,
+		SignCount:   authData.SignCount,
+		AAGUID:      hex.EncodeToString(authData.AAGUID),
+		Transports:  input.Response.Transports,
+		Attestation: format,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+	}
+	err = c.usersRepo.AddWebAuthnCredential(user.Id.Hex(), credential)
+	if err != nil {
+		log.Printf("c.usersRepo.AddWebAuthnCredential| %s finish registration failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	log.Printf("Registered %s webauthn credential for user %s\n", format, user.Id.Hex())
+
+	response := fiber.Map{"credential": credential}
+	if len(user.RecoveryCodes) == 0 {
+		codes, err := c.resetRecoveryCodes(user)
+		if err != nil {
+			return ctx.
+				Status(http.StatusInternalServerError).
+				JSON(util.NewJError(err))
+		}
+		response["recovery_codes"] = codes
+	}
+	return ctx.
+		Status(http.StatusCreated).
+		JSON(response)
+}
+
+// BeginWebAuthnLogin Handler Function starts signing in with a passkey. Given the MFA token
+// of a sign in, the user's credentials are asked for as a second factor; otherwise any
+// discoverable credential signs in without a password.
+// @Summary Begin passkey sign in
+// @Description Get the options for navigator.credentials.get()
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param mfa_token body string false "MFA challenge token of a sign in"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/webauthn/login/begin [post]
+func (c *authController) BeginWebAuthnLogin(ctx *fiber.Ctx) error {
+	var input struct {
+		MFAToken string `json:"mfa_token" form:"mfa_token"`
+	}
+	if len(ctx.Body()) > 0 {
+		err := ctx.BodyParser(&input)
+		if err != nil {
+			return ctx.
+				Status(http.StatusUnprocessableEntity).
+				JSON(util.NewJError(err))
+		}
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+
+	purpose, userId := models.WebAuthnLogin, ""
+	allowed := []fiber.Map{}
+	verification := userVerificationRequired
+	if input.MFAToken != "" {
+		userId, err = c.tokensRepo.RetrieveMFAChallenge(input.MFAToken)
+		var user *models.User
+		if err == nil {
+			user, err = c.usersRepo.GetById(userId)
+		}
+		if err != nil || len(user.WebAuthnCredentials) == 0 {
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(util.ErrInvalidMFAToken))
+		}
+		purpose = models.WebAuthnMFA
+		allowed = credentialDescriptors(user)
+		verification = userVerificationPreferred
+	}
+
+	challenge, err := c.newWebAuthnSession(userId, purpose)
+	if err != nil {
+		log.Printf("c.newWebAuthnSession| begin webauthn login failed: %v\n", err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"challenge":        challenge,
+			"rpId":             rp.Id,
+			"timeout":          security.WebAuthnTimeout.Milliseconds(),
+			"allowCredentials": allowed,
+			"userVerification": verification,
+		})
+}
+
+// FinishWebAuthnLogin Handler Function verifies a passkey assertion and signs the user in
+// @Summary Finish passkey sign in
+// @Description Sign in with the credential returned by navigator.credentials.get()
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param credential body models.WebAuthnCredentialInput true "Public key credential"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} util.JError
+// @Failure 403 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Router /api/v1/webauthn/login/finish [post]
+func (c *authController) FinishWebAuthnLogin(ctx *fiber.Ctx) error {
+	var input models.WebAuthnCredentialInput
+	err := ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	clientDataJSON, session, err := c.useWebAuthnSession(&input, security.WebAuthnGet, rp, "", "")
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+	user, credential, err := c.verifyAssertion(&input, clientDataJSON, session, rp)
+	if err != nil {
+		log.Printf("c.verifyAssertion| webauthn login failed: %v\n", err.Error())
+		// A failed second factor counts against the account like a wrong password
+		if session.Purpose == models.WebAuthnMFA {
+			if challenged, err := c.usersRepo.GetById(session.User); err == nil {
+				c.failSignIn(ctx, challenged.Email)
+			}
+		}
+		return ctx.
+			Status(http.StatusUnauthorized).
+			JSON(util.NewJError(err))
+	}
+
+	if session.Purpose == models.WebAuthnMFA {
+		// The challenge is answered now, so it can't be answered again
+		challengeUser, err := c.tokensRepo.UseMFAChallenge(input.MFAToken)
+		if err != nil || challengeUser != session.User {
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(util.ErrInvalidMFAToken))
+		}
+		err = c.tokensRepo.DeleteMFAChallenge(input.MFAToken)
+		if err != nil {
+			log.Printf("c.tokensRepo.DeleteMFAChallenge| %s webauthn login failed: %v\n", session.User, err.Error())
+		}
+	} else if security.RequireVerifiedEmail && !user.EmailVerified {
+		// Signing in without a password skips SignIn, so its checks apply here
+		return ctx.
+			Status(http.StatusForbidden).
+			JSON(util.NewJError(util.ErrEmailNotVerified))
+	}
+
+	log.Printf("User %s signed in with webauthn credential %s\n", user.Id.Hex(), credential.Id)
+	return c.completeSignIn(ctx, user)
+}
+
+// BeginWebAuthnReauthentication Handler Function asks a signed in user for one of their
+// passkeys, to prove their second factor once more before changing it
+// @Summary Begin passkey reauthentication
+// @Description Get the options for navigator.credentials.get(), answered as the assertion of a second factor
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/webauthn/reauth/begin [post]
+func (c *authController) BeginWebAuthnReauthentication(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	rp, err := relyingParty()
+	if err != nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(err))
+	}
+	if len(user.WebAuthnCredentials) == 0 {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(util.ErrNoWebAuthnCredentials))
+	}
+	challenge, err := c.newWebAuthnSession(user.Id.Hex(), models.WebAuthnReauth)
+	if err != nil {
+		log.Printf("c.newWebAuthnSession| %s begin reauthentication failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(fiber.Map{
+			"challenge":        challenge,
+			"rpId":             rp.Id,
+			"timeout":          security.WebAuthnTimeout.Milliseconds(),
+			"allowCredentials": credentialDescriptors(user),
+			"userVerification": userVerificationPreferred,
+		})
+}
+
+// GetWebAuthnCredentials Handler Function lists the passkeys and security keys of the
+// signed in user
+// @Summary List passkeys
+// @Description List own passkeys and security keys
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Success 200 {array} models.WebAuthnCredential
+// @Failure 401 {object} util.JError
+// @Router /api/v1/webauthn/credentials [get]
+func (c *authController) GetWebAuthnCredentials(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	credentials := user.WebAuthnCredentials
+	if credentials == nil {
+		credentials = []models.WebAuthnCredential{}
+	}
+	return ctx.
+		Status(http.StatusOK).
+		JSON(credentials)
+}
+
+// DeleteWebAuthnCredential Handler Function removes a passkey or security key of the
+// signed in user, after proving a second factor once more
+// @Summary Delete a passkey
+// @Description Delete an own passkey or security key by id with a TOTP code, recovery code or passkey assertion
+// @Tags WebAuthn
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "specific user token"
+// @Param id path string true "Credential ID"
+// @Param code body models.MFACodeInput true "TOTP code, recovery code or passkey assertion"
+// @Success 204
+// @Failure 400 {object} util.JError
+// @Failure 401 {object} util.JError
+// @Failure 404 {object} util.JError
+// @Failure 422 {object} util.JError
+// @Failure 429 {object} util.JError
+// @Failure 500 {object} util.JError
+// @Router /api/v1/webauthn/credentials/{id} [delete]
+func (c *authController) DeleteWebAuthnCredential(ctx *fiber.Ctx) error {
+	user, status, err := c.authUser(ctx)
+	if err != nil {
+		return ctx.
+			Status(status).
+			JSON(util.NewJError(err))
+	}
+	credentialId, err := url.PathUnescape(ctx.Params("id"))
+	if err != nil {
+		credentialId = ctx.Params("id")
+	}
+	if user.WebAuthnCredential(credentialId) == nil {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrWebAuthnCredentialUnknown))
+	}
+	var input models.MFACodeInput
+	err = ctx.BodyParser(&input)
+	if err != nil {
+		return ctx.
+			Status(http.StatusUnprocessableEntity).
+			JSON(util.NewJError(err))
+	}
+	wait, err := c.proveSecondFactor(ctx, user, &input)
+	if wait > 0 {
+		return tooManyRequests(ctx, wait, util.ErrSignInThrottled)
+	}
+	if err != nil {
+		return ctx.
+			Status(http.StatusBadRequest).
+			JSON(util.NewJError(err))
+	}
+
+	removed, err := c.usersRepo.RemoveWebAuthnCredential(user.Id.Hex(), credentialId)
+	if err != nil {
+		log.Printf("c.usersRepo.RemoveWebAuthnCredential| %s delete credential failed: %v\n", user.Id.Hex(), err.Error())
+		return ctx.
+			Status(http.StatusInternalServerError).
+			JSON(util.NewJError(err))
+	}
+	if !removed {
+		return ctx.
+			Status(http.StatusNotFound).
+			JSON(util.NewJError(util.ErrWebAuthnCredentialUnknown))
+	}
+	log.Printf("Removed webauthn credential %s of user %s\n", credentialId, user.Id.Hex())
+
+	// Recovery codes are only kept while there is a second factor to recover
+	if user.TOTPSecret == "" && len(user.WebAuthnCredentials) == 1 && len(user.RecoveryCodes) > 0 {
+		user.RecoveryCodes = nil
+		user.UpdatedAt = time.Now()
+		err = c.usersRepo.UpdateMFA(user)
+		if err != nil {
+			log.Printf("c.usersRepo.UpdateMFA| %s delete credential failed: %v\n", user.Id.Hex(), err.Error())
+		}
+	}
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+/********************************************************
+* 					Helper functions					*
+*********************************************************/
+
+// newWebAuthnSession stores a new ceremony and returns its challenge
+func (c *authController) newWebAuthnSession(userId, purpose string) (string, error) {
+	challenge, err := security.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	err = c.tokensRepo.CreateWebAuthnSession(&models.WebAuthnSession{
+		Challenge: challenge,
+		User:      userId,
+		Purpose:   purpose,
+	})
+	return challenge, err
+}
+
+// useWebAuthnSession checks the client data of a response and uses up the
+// ceremony it answers. When purpose and userId are given the ceremony has to
+// match them, otherwise only sign in ceremonies are answered.
+func (c *authController) useWebAuthnSession(input *models.WebAuthnCredentialInput, typ string, rp *security.RelyingParty, purpose, userId string) ([]byte, *models.WebAuthnSession, error) {
+	if input.Type != webauthnCredentialType {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	clientDataJSON, err := unb64url(input.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	clientData, err := security.ParseClientData(clientDataJSON, typ, rp)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := c.tokensRepo.ConsumeWebAuthnSession(clientData.Challenge)
+	if err != nil {
+		return nil, nil, util.ErrInvalidWebAuthnChallenge
+	}
+	if purpose != "" && (session.Purpose != purpose || session.User != userId) {
+		return nil, nil, util.ErrInvalidWebAuthnChallenge
+	}
+	if purpose == "" && session.Purpose != models.WebAuthnLogin && session.Purpose != models.WebAuthnMFA {
+		return nil, nil, util.ErrInvalidWebAuthnChallenge
+	}
+	return clientDataJSON, session, nil
+}
+
+// verifyReauthentication checks an assertion answering a reauthentication
+// ceremony of the user
+func (c *authController) verifyReauthentication(user *models.User, input *models.WebAuthnCredentialInput) error {
+	rp, err := relyingParty()
+	if err != nil {
+		return err
+	}
+	clientDataJSON, session, err := c.useWebAuthnSession(input, security.WebAuthnGet, rp, models.WebAuthnReauth, user.Id.Hex())
+	if err != nil {
+		return err
+	}
+	_, _, err = c.verifyAssertion(input, clientDataJSON, session, rp)
+	return err
+}
+
+// verifyAssertion checks that an assertion was signed by a registered
+// credential allowed to answer the ceremony, and records its use
+func (c *authController) verifyAssertion(input *models.WebAuthnCredentialInput, clientDataJSON []byte, session *models.WebAuthnSession, rp *security.RelyingParty) (*models.User, *models.WebAuthnCredential, error) {
+	rawId, err := unb64url(input.RawId)
+	if err != nil {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	user, err := c.usersRepo.GetByWebAuthnCredential(b64url(rawId))
+	if err != nil {
+		return nil, nil, util.ErrWebAuthnCredentialUnknown
+	}
+	credential := user.WebAuthnCredential(b64url(rawId))
+	if credential == nil {
+		return nil, nil, util.ErrWebAuthnCredentialUnknown
+	}
+	if session.User != "" && session.User != user.Id.Hex() {
+		return nil, nil, util.ErrWebAuthnCredentialUnknown
+	}
+	if input.Response.UserHandle != "" {
+		handle, err := unb64url(input.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, user.Id[:]) {
+			return nil, nil, util.ErrWebAuthnCredentialUnknown
+		}
+	}
+
+	rawAuthData, err := unb64url(input.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	authData, err := security.ParseAuthenticatorData(rawAuthData, rp)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Without a password, the passkey has to be both factors
+	if session.Purpose == models.WebAuthnLogin && !authData.UserVerified() {
+		return nil, nil, util.ErrWebAuthnUserVerification
+	}
+	signature, err := unb64url(input.Response.Signature)
+	if err != nil {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	err = security.VerifyAssertion(credential.PublicKey, rawAuthData, clientDataJSON, signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Authenticators that count signatures never go backwards, unless the
+	// credential was copied to another device
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		log.Printf("User %s webauthn credential %s sign count went from %d to %d\n", user.Id.Hex(), credential.Id, credential.SignCount, authData.SignCount)
+		return nil, nil, util.ErrWebAuthnSignCount
+	}
+	credential.SignCount = authData.SignCount
+	credential.LastUsedAt = time.Now()
+	err = c.usersRepo.UpdateWebAuthnCredential(user.Id.Hex(), credential)
+	if err != nil {
+		log.Printf("c.usersRepo.UpdateWebAuthnCredential| %s webauthn login failed: %v\n", user.Id.Hex(), err.Error())
+	}
+	return user, credential, nil
+}
+
+// credentialDescriptors lists the credentials of the user for the options of
+// a ceremony
+func credentialDescriptors(user *models.User) []fiber.Map {
+	descriptors := make([]fiber.Map, 0, len(user.WebAuthnCredentials))
+	for _, credential := range user.WebAuthnCredentials {
+		descriptor := fiber.Map{"type": webauthnCredentialType, "id": credential.Id}
+		if len(credential.Transports) > 0 {
+			descriptor["transports"] = credential.Transports
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors
+}
+
+// relyingParty describes this service to authenticators, or fails while
+// WebAuthn is not configured
+func relyingParty() (*security.RelyingParty, error) {
+	if security.WebAuthn == nil {
+		return nil, util.ErrWebAuthnDisabled
+	}
+	return security.WebAuthn, nil
+}
+
+// b64url encodes binary WebAuthn values the way browsers serialize them
+func b64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// unb64url decodes a base64url value, with or without padding
+func unb64url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
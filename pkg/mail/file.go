@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************
+* 					File mailer							*
+*********************************************************/
+
+// fileMailer writes every email to its own .eml file in a directory, for
+// development and tests
+type fileMailer struct {
+	dir  string
+	from string
+	seq  uint64
+}
+
+// NewFileMailer returns a Mailer writing messages to dir
+func NewFileMailer(dir, from string) Mailer {
+	return &fileMailer{dir: dir, from: from}
+}
+
+func (m *fileMailer) Send(msg *Message) error {
+	body, err := compose(m.from, msg)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	// The sequence keeps names unique and in sending order within a run
+	name := fmt.Sprintf("%d-%04d.eml", time.Now().UnixNano(), atomic.AddUint64(&m.seq, 1))
+	return os.WriteFile(filepath.Join(m.dir, name), body, 0600)
+}
+
+/********************************************************
+* 					Log mailer							*
+*********************************************************/
+
+// logMailer writes email to the log. Bodies carry sign in links and codes,
+// so they are only logged when asked for, to follow links during development.
+type logMailer struct {
+	bodies bool
+}
+
+// NewLogMailer returns a Mailer logging messages, with their text body when
+// bodies is set
+func NewLogMailer(bodies bool) Mailer {
+	return logMailer{bodies: bodies}
+}
+
+func (m logMailer) Send(msg *Message) error {
+	if !m.bodies {
+		log.Printf("Mail to %s: %s\n", msg.To, msg.Subject)
+		return nil
+	}
+	log.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Text)
+	return nil
+}
@@ -0,0 +1,238 @@
+package mail
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DriverSMTP = "smtp"
+	DriverFile = "file"
+	DriverLog  = "log"
+
+	defaultFrom          = "no-reply@localhost"
+	defaultRetryAttempts = 5
+	defaultRetryBackoff  = 30 * time.Second
+	defaultQueueSize     = 256
+	defaultWorkers       = 4
+	defaultSMTPTimeout   = 30 * time.Second
+)
+
+// Message is an email ready to be delivered
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers email
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Outbox sends every email of the service. Until InitMailer ran it logs them,
+// without their bodies.
+var Outbox Mailer = NewLogMailer(false)
+
+// The pages the links in emails point to. Each link carries a token the page
+// posts to the API.
+var (
+	PasswordResetURL     string
+	EmailVerificationURL string
+	MagicLinkURL         string
+)
+
+// InitMailer configures outbound mail from the environment. MAIL_DRIVER selects
+// smtp, file or log and is required. SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD and SMTP_TIMEOUT configure smtp, MAIL_DIR the directory file
+// writes to, MAIL_LOG_BODIES whether log includes message bodies and MAIL_FROM
+// the sender. MAIL_DEFAULT_LOCALE is the language used when a request asks for
+// none that is supported. Sends are queued for MAIL_WORKERS senders and failed
+// ones retried up to MAIL_RETRY_ATTEMPTS times, MAIL_RETRY_BACKOFF apart at
+// first. PASSWORD_RESET_URL, EMAIL_VERIFICATION_URL and MAGIC_LINK_URL are the
+// frontend pages reset, verification and sign in links point to, and required.
+func InitMailer() error {
+	var err error
+	PasswordResetURL, err = pageURL("PASSWORD_RESET_URL")
+	if err != nil {
+		return err
+	}
+	EmailVerificationURL, err = pageURL("EMAIL_VERIFICATION_URL")
+	if err != nil {
+		return err
+	}
+	MagicLinkURL, err = pageURL("MAGIC_LINK_URL")
+	if err != nil {
+		return err
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultFrom
+	}
+
+	var driver Mailer
+	switch name := os.Getenv("MAIL_DRIVER"); name {
+	case "":
+		return fmt.Errorf("MAIL_DRIVER: %w", util.ErrInvalidMailConfig)
+	case DriverLog:
+		bodies := false
+		if value := os.Getenv("MAIL_LOG_BODIES"); value != "" {
+			bodies, err = strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("MAIL_LOG_BODIES: %w", util.ErrInvalidMailConfig)
+			}
+		}
+		driver = NewLogMailer(bodies)
+	case DriverFile:
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			return fmt.Errorf("MAIL_DIR: %w", util.ErrInvalidMailConfig)
+		}
+		driver = NewFileMailer(dir, from)
+	case DriverSMTP:
+		host := os.Getenv("SMTP_HOST")
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		if host == "" {
+			return fmt.Errorf("SMTP_HOST: %w", util.ErrInvalidMailConfig)
+		}
+		timeout := defaultSMTPTimeout
+		if value := os.Getenv("SMTP_TIMEOUT"); value != "" {
+			timeout, err = time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("SMTP_TIMEOUT: %w", util.ErrInvalidMailConfig)
+			}
+		}
+		driver = NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from, timeout)
+	default:
+		return fmt.Errorf("%w: %s", util.ErrUnsupportedMailDriver, name)
+	}
+
+	attempts := defaultRetryAttempts
+	if value := os.Getenv("MAIL_RETRY_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("MAIL_RETRY_ATTEMPTS: %w", util.ErrInvalidMailConfig)
+		}
+		attempts = n
+	}
+	workers := defaultWorkers
+	if value := os.Getenv("MAIL_WORKERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("MAIL_WORKERS: %w", util.ErrInvalidMailConfig)
+		}
+		workers = n
+	}
+	backoff := defaultRetryBackoff
+	if value := os.Getenv("MAIL_RETRY_BACKOFF"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("MAIL_RETRY_BACKOFF: %w", util.ErrInvalidMailConfig)
+		}
+		backoff = d
+	}
+
+	if locale := os.Getenv("MAIL_DEFAULT_LOCALE"); locale != "" {
+		if _, ok := templates[locale]; !ok {
+			return fmt.Errorf("MAIL_DEFAULT_LOCALE: %w", util.ErrUnsupportedLocale)
+		}
+		DefaultLocale = locale
+	}
+
+	Outbox = NewQueue(driver, defaultQueueSize, workers, attempts, backoff)
+	return nil
+}
+
+// pageURL reads the absolute http(s) URL of a frontend page from the variable
+// name. Links are never built from the request, whose host the sender picks.
+func pageURL(name string) (string, error) {
+	page := os.Getenv(name)
+	parsed, err := url.Parse(page)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") ||
+		parsed.Host == "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("%s: %w", name, util.ErrInvalidMailConfig)
+	}
+	return page, nil
+}
+
+// compose encodes msg as a MIME message with a plain text and, when there is
+// one, an HTML alternative
+func compose(from string, msg *Message) ([]byte, error) {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return nil, util.ErrInvalidRecipient
+	}
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageId(from))
+	header("MIME-Version", "1.0")
+
+	if msg.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "8bit")
+		buf.WriteString("\r\n")
+		buf.WriteString(crlf(msg.Text))
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, alt := range []struct{ mediaType, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	} {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alt.mediaType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write([]byte(crlf(alt.body))); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// messageId makes a unique Message-ID in the sender's domain
+func messageId(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndexByte(from, '@'); i >= 0 {
+		domain = strings.TrimRight(from[i+1:], ">")
+	}
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(buf), domain)
+}
+
+// crlf normalizes line endings to the CRLF mail requires
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
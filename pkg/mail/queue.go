@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"time"
+)
+
+// queue hands messages to background workers so sending never holds up a
+// request, nor does one slow delivery hold up the others. Failed sends are
+// retried with exponential backoff until the attempts run out. The queue lives
+// in memory, so messages still waiting when the process exits are lost.
+type queue struct {
+	mailer   Mailer
+	jobs     chan *job
+	attempts int
+	backoff  time.Duration
+}
+
+// job is a message waiting to be sent and how often sending it failed
+type job struct {
+	msg      *Message
+	failures int
+}
+
+// NewQueue returns a Mailer queueing up to size messages for mailer, sent by
+// workers at once and each tried at most attempts times with backoff doubling
+// after every failure
+func NewQueue(mailer Mailer, size, workers, attempts int, backoff time.Duration) Mailer {
+	q := &queue{
+		mailer:   mailer,
+		jobs:     make(chan *job, size),
+		attempts: attempts,
+		backoff:  backoff,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Send queues msg. It only fails when the queue is full.
+func (q *queue) Send(msg *Message) error {
+	return q.push(&job{msg: msg})
+}
+
+func (q *queue) push(j *job) error {
+	select {
+	case q.jobs <- j:
+		return nil
+	default:
+		return util.ErrMailQueueFull
+	}
+}
+
+func (q *queue) work() {
+	for j := range q.jobs {
+		err := q.mailer.Send(j.msg)
+		if err == nil {
+			continue
+		}
+		j.failures++
+		if j.failures >= q.attempts {
+			log.Printf("q.mailer.Send| mail to %s dropped after %d attempts: %v\n", j.msg.To, j.failures, err.Error())
+			continue
+		}
+		delay := q.backoff << (j.failures - 1)
+		log.Printf("q.mailer.Send| mail to %s failed, retrying in %s: %v\n", j.msg.To, delay, err.Error())
+		retry := j
+		time.AfterFunc(delay, func() {
+			if err := q.push(retry); err != nil {
+				log.Printf("q.push| mail to %s dropped: %v\n", retry.msg.To, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// smtpMailer delivers email through an SMTP server, upgrading the connection
+// with STARTTLS when the server offers it. Every send, from dialing to QUIT,
+// has to finish within timeout so a stalled server can't hold up the queue.
+type smtpMailer struct {
+	host    string
+	addr    string
+	auth    smtp.Auth
+	from    string
+	timeout time.Duration
+}
+
+// NewSMTPMailer returns a Mailer sending through host:port. Without a
+// username no authentication is attempted.
+func NewSMTPMailer(host, port, username, password, from string, timeout time.Duration) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{
+		host:    host,
+		addr:    net.JoinHostPort(host, port),
+		auth:    auth,
+		from:    from,
+		timeout: timeout,
+	}
+}
+
+func (m *smtpMailer) Send(msg *Message) error {
+	body, err := compose(m.from, msg)
+	if err != nil {
+		return err
+	}
+	// The envelope takes bare addresses, while the header may carry a name
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: m.timeout}
+	conn, err := dialer.Dial("tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(m.timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: m.host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			err = client.Auth(m.auth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = data.Write(body); err != nil {
+		return err
+	}
+	if err = data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
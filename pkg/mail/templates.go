@@ -0,0 +1,144 @@
+package mail
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+// Kinds of email the service sends. Every kind has a <kind>.txt and a
+// <kind>.html template in each locale directory under templates.
+const (
+	KindVerifyEmail   = "verify_email"
+	KindPasswordReset = "password_reset"
+	KindMagicLink     = "magic_link"
+	KindSignInCode    = "sign_in_code"
+)
+
+// templateLayout wraps the body of every HTML email
+const templateLayout = "templates/layout.html"
+
+//go:embed templates
+var templateFS embed.FS
+
+// DefaultLocale is used when none of the locales a request accepts is supported
+var DefaultLocale = "en"
+
+// templates holds the parsed templates by locale and kind
+var templates = mustParseTemplates()
+
+// Data is what a template is rendered with
+type Data map[string]interface{}
+
+// messageTemplate renders one kind of email in one locale. The text template
+// defines "subject" and "body", the HTML one "content" for the layout.
+type messageTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// Render builds an email of kind in locale, falling back to DefaultLocale
+// when the kind was not translated. The locale used is passed to the
+// templates as .Locale.
+func Render(kind, locale string, data Data) (*Message, error) {
+	t, ok := templates[locale][kind]
+	if !ok {
+		locale = DefaultLocale
+		t, ok = templates[locale][kind]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", util.ErrUnknownMailTemplate, kind)
+	}
+	values := Data{"Locale": locale}
+	for k, v := range data {
+		values[k] = v
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", values); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, "body", values); err != nil {
+		return nil, err
+	}
+	if err := t.html.ExecuteTemplate(&html, "layout", values); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// Locale picks the supported locale that best matches an Accept-Language
+// header, or DefaultLocale
+func Locale(acceptLanguage string) string {
+	supported := []language.Tag{language.Make(DefaultLocale)}
+	names := []string{DefaultLocale}
+	for locale := range templates {
+		if locale != DefaultLocale {
+			names = append(names, locale)
+		}
+	}
+	// Map iteration is random, keep the matcher's tie breaking stable
+	sort.Strings(names[1:])
+	for _, name := range names[1:] {
+		supported = append(supported, language.Make(name))
+	}
+
+	_, index, confidence := language.NewMatcher(supported).Match(parseAcceptLanguage(acceptLanguage)...)
+	if confidence == language.No {
+		return DefaultLocale
+	}
+	return names[index]
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header in
+// order of preference, ignoring a malformed header
+func parseAcceptLanguage(header string) []language.Tag {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// mustParseTemplates parses every embedded template. They ship with the
+// binary, so a broken one is a programming error.
+func mustParseTemplates() map[string]map[string]*messageTemplate {
+	parsed := map[string]map[string]*messageTemplate{}
+	locales, err := fs.ReadDir(templateFS, "templates")
+	if err != nil {
+		panic(err)
+	}
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		dir := path.Join("templates", locale.Name())
+		files, err := fs.Glob(templateFS, path.Join(dir, "*.txt"))
+		if err != nil {
+			panic(err)
+		}
+		parsed[locale.Name()] = map[string]*messageTemplate{}
+		for _, file := range files {
+			kind := strings.TrimSuffix(path.Base(file), ".txt")
+			parsed[locale.Name()][kind] = &messageTemplate{
+				text: texttemplate.Must(texttemplate.ParseFS(templateFS, file)),
+				html: htmltemplate.Must(htmltemplate.ParseFS(templateFS, templateLayout, path.Join(dir, kind+".html"))),
+			}
+		}
+	}
+	return parsed
+}
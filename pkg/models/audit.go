@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records an action a user performed on another user's account
+type AuditEntry struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Actor     string             `json:"actor" bson:"actor"`
+	Action    string             `json:"action" bson:"action"`
+	Target    string             `json:"target" bson:"target"`
+	IP        string             `json:"ip" bson:"ip"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+// Client is an application registered to request tokens through OAuth 2.0.
+// Confidential clients authenticate with a secret, of which only the hash is
+// stored, and may use the client credentials grant for the Scopes an
+// administrator allowed. Resource servers may introspect every token, other
+// clients only the tokens issued to them.
+type Client struct {
+	Id             string    `json:"client_id" bson:"_id"`
+	Name           string    `json:"name" bson:"name"`
+	RedirectURIs   []string  `json:"redirect_uris" bson:"redirect_uris"`
+	Confidential   bool      `json:"confidential" bson:"confidential"`
+	SecretHash     string    `json:"-" bson:"secret_hash,omitempty"`
+	Scopes         []string  `json:"scopes" bson:"scopes"`
+	ResourceServer bool      `json:"resource_server" bson:"resource_server"`
+	Owner          string    `json:"owner" bson:"owner"`
+	CreatedAt      time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// AuthorizationCode is the grant a user approved on the consent screen,
+// waiting to be exchanged at the token endpoint. RedirectURI is empty unless
+// the authorization request named one.
+type AuthorizationCode struct {
+	ClientId            string `json:"client_id"`
+	User                string `json:"user"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+}
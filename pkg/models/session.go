@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a sign-in of a user on one device or client. It lives as long as
+// the token family it was started with, so Id is the family id and the "sid"
+// claim of every access token issued in it. LastUsedAt, IP and UserAgent are
+// only recorded about once a minute.
+type Session struct {
+	Id         string    `json:"id"`
+	User       string    `json:"-"`
+	ClientId   string    `json:"client_id,omitempty"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
@@ -0,0 +1,13 @@
+package models
+
+// RefreshToken is the server side state of an opaque refresh token. Every
+// token minted by rotating another one shares its Family, and Uses counts how
+// many times the token has been presented. ClientId and Scope are set for
+// tokens issued through OAuth 2.0.
+type RefreshToken struct {
+	User     string `json:"user"`
+	Family   string `json:"family"`
+	ClientId string `json:"client_id"`
+	Scope    string `json:"scope"`
+	Uses     int64  `json:"uses"`
+}
@@ -5,12 +5,157 @@ import (
 	"time"
 )
 
+// User is an account as it is stored. It is never sent to clients as is, see
+// PublicUser. Roles and Permissions decide what the user may do to other
+// accounts; Admin mirrors whether Roles contains the admin role and is still
+// honoured for accounts created before roles existed.
 type User struct {
-	Id        primitive.ObjectID `json:"id" bson:"_id"`
-	Name      string             `json:"name" bson:"name"`
-	Email     string             `json:"email" bson:"email"`
-	Password  string             `json:"password" bson:"password"`
-	Admin     bool               `json:"admin" bson:"admin"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	Name        string             `json:"name" bson:"name"`
+	Email       string             `json:"email" bson:"email"`
+	Password    string             `json:"-" bson:"password"`
+	Admin       bool               `json:"admin" bson:"admin"`
+	Roles       []string           `json:"roles" bson:"roles"`
+	Permissions []string           `json:"permissions,omitempty" bson:"permissions,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+
+	// PasswordHistory holds the hashes of the passwords used before the
+	// current one, most recent first
+	PasswordHistory   []string  `json:"-" bson:"password_history,omitempty"`
+	PasswordChangedAt time.Time `json:"-" bson:"password_changed_at"`
+
+	// EmailVerified is set once the user followed a verification link sent
+	// to Email, and cleared whenever Email changes
+	EmailVerified bool `json:"email_verified" bson:"email_verified"`
+
+	// TOTPSecret is the secret of the user's authenticator app once its
+	// enrollment was confirmed. TOTPLastStep is the time step of the last code
+	// accepted, so no code can be used twice, and RecoveryCodes hold the
+	// token hashes of the recovery codes not used yet.
+	TOTPSecret    string   `json:"-" bson:"totp_secret,omitempty"`
+	TOTPLastStep  int64    `json:"-" bson:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"-" bson:"recovery_codes,omitempty"`
+
+	// WebAuthnCredentials are the user's passkeys and security keys
+	WebAuthnCredentials []WebAuthnCredential `json:"-" bson:"webauthn_credentials,omitempty"`
+}
+
+// MFAEnabled reports whether signing in with a password takes a second factor
+func (user *User) MFAEnabled() bool {
+	return user.TOTPSecret != "" || len(user.WebAuthnCredentials) > 0
+}
+
+// WebAuthnCredential returns the user's credential with the given id
+func (user *User) WebAuthnCredential(id string) *WebAuthnCredential {
+	for i := range user.WebAuthnCredentials {
+		if user.WebAuthnCredentials[i].Id == id {
+			return &user.WebAuthnCredentials[i]
+		}
+	}
+	return nil
+}
+
+// SignUpInput is the body of a sign up request
+type SignUpInput struct {
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+// SignInInput is the body of a sign in request
+type SignInInput struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+// MagicSignInInput is the body of a passwordless sign in request. Method is
+// "link" or "code", a link when empty.
+type MagicSignInInput struct {
+	Email  string `json:"email" form:"email"`
+	Method string `json:"method" form:"method"`
+}
+
+// MagicSignInVerifyInput completes a passwordless sign in with either the
+// token of a sign in link or the address and the code emailed to it
+type MagicSignInVerifyInput struct {
+	Token string `json:"token" form:"token"`
+	Email string `json:"email" form:"email"`
+	Code  string `json:"code" form:"code"`
+}
+
+// MFACodeInput is the body of requests proving a second factor, with either a
+// code from the authenticator app or an unused recovery code. MFAToken names
+// the challenge being answered when signing in. Signed in users proving their
+// second factor once more may answer a reauthentication ceremony with one of
+// their passkeys instead.
+type MFACodeInput struct {
+	MFAToken     string                   `json:"mfa_token,omitempty" form:"mfa_token"`
+	Code         string                   `json:"code" form:"code"`
+	RecoveryCode string                   `json:"recovery_code" form:"recovery_code"`
+	Assertion    *WebAuthnCredentialInput `json:"assertion,omitempty" form:"-"`
+}
+
+// UpdateUserInput is the body of a user update. Empty fields are left unchanged.
+type UpdateUserInput struct {
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+// PublicUser is the view of a user returned by the API
+type PublicUser struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Admin       bool      `json:"admin"`
+	Roles       []string  `json:"roles"`
+	Permissions []string  `json:"permissions,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+	EmailVerified     bool      `json:"email_verified"`
+	MFAEnabled        bool      `json:"mfa_enabled"`
+}
+
+// NewUser maps a sign up request to a user. The password is still in clear
+// text and has to be hashed before the user is saved.
+func (in *SignUpInput) NewUser() *User {
+	return &User{
+		Name:     in.Name,
+		Email:    in.Email,
+		Password: in.Password,
+	}
+}
+
+// NewPublicUser maps a user to the view returned by the API
+func NewPublicUser(user *User) *PublicUser {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return &PublicUser{
+		Id:          user.Id.Hex(),
+		Name:        user.Name,
+		Email:       user.Email,
+		Admin:       user.Admin,
+		Roles:       roles,
+		Permissions: user.Permissions,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+
+		PasswordChangedAt: user.PasswordChangedAt,
+		EmailVerified:     user.EmailVerified,
+		MFAEnabled:        user.MFAEnabled(),
+	}
+}
+
+// NewPublicUsers maps every user to the view returned by the API
+func NewPublicUsers(users []*User) []*PublicUser {
+	views := make([]*PublicUser, 0, len(users))
+	for _, user := range users {
+		views = append(views, NewPublicUser(user))
+	}
+	return views
 }
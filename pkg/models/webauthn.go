@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Purposes of a WebAuthn ceremony
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+	WebAuthnMFA          = "mfa"
+	WebAuthnReauth       = "reauth"
+)
+
+// WebAuthnCredential is a passkey or security key registered to a user. Id is
+// the base64url encoded credential id and PublicKey the COSE encoded key.
+type WebAuthnCredential struct {
+	Id          string    `json:"id" bson:"id"`
+	Name        string    `json:"name" bson:"name"`
+	PublicKey   []byte    `json:"-" bson:"public_key"`
+	Algorithm   int64     `json:"algorithm" bson:"algorithm"`
+	SignCount   uint32    `json:"sign_count" bson:"sign_count"`
+	AAGUID      string    `json:"aaguid" bson:"aaguid"`
+	Transports  []string  `json:"transports,omitempty" bson:"transports,omitempty"`
+	Attestation string    `json:"attestation" bson:"attestation"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at" bson:"last_used_at"`
+}
+
+// WebAuthnSession is a WebAuthn ceremony waiting for the authenticator's
+// response. User is empty for a passwordless login, where the credential
+// tells who signs in.
+type WebAuthnSession struct {
+	Challenge string `json:"challenge"`
+	User      string `json:"user,omitempty"`
+	Purpose   string `json:"purpose"`
+}
+
+// WebAuthnCredentialInput is a PublicKeyCredential as serialized by the
+// browser's toJSON(), with binary fields base64url encoded. The response
+// holds the attestation when registering and the assertion when signing in.
+type WebAuthnCredentialInput struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject,omitempty"`
+		Transports        []string `json:"transports,omitempty"`
+		AuthenticatorData string   `json:"authenticatorData,omitempty"`
+		Signature         string   `json:"signature,omitempty"`
+		UserHandle        string   `json:"userHandle,omitempty"`
+	} `json:"response"`
+
+	// Name labels a credential being registered
+	Name string `json:"name,omitempty"`
+	// MFAToken names the sign in challenge a second factor answers
+	MFAToken string `json:"mfa_token,omitempty"`
+	// Code, RecoveryCode or Assertion prove the user's second factor once
+	// more when a credential is registered while one is enabled
+	Code         string                   `json:"code,omitempty"`
+	RecoveryCode string                   `json:"recovery_code,omitempty"`
+	Assertion    *WebAuthnCredentialInput `json:"assertion,omitempty"`
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/db"
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const AuditCollection = "audit"
+
+type AuditRepository interface {
+	Record(entry *models.AuditEntry) error
+}
+
+type auditRepository struct {
+	coll *mongo.Collection
+}
+
+func NewAuditRepository(conn db.MongoConnection) AuditRepository {
+	return &auditRepository{
+		conn.DB().Collection(AuditCollection),
+	}
+}
+
+func (r *auditRepository) Record(entry *models.AuditEntry) error {
+	_, err := r.coll.InsertOne(context.TODO(), entry)
+	if err == nil {
+		log.Printf("Audit: %s %s %s\n", entry.Actor, entry.Action, entry.Target)
+	}
+	return err
+}
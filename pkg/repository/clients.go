@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/db"
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const ClientCollection = "clients"
+
+type ClientsRepository interface {
+	Save(client *models.Client) error
+	GetById(id string) (client *models.Client, err error)
+	GetByOwner(owner string) (clients []*models.Client, err error)
+	UpdateAccess(client *models.Client) error
+	Delete(id string) error
+}
+
+type clientsRepository struct {
+	coll *mongo.Collection
+}
+
+func NewClientRepository(conn db.MongoConnection) ClientsRepository {
+	return &clientsRepository{
+		conn.DB().Collection(ClientCollection),
+	}
+}
+
+func (r *clientsRepository) Save(client *models.Client) error {
+	res, err := r.coll.InsertOne(context.TODO(), client)
+	if res != nil {
+		log.Printf("Saved client: %v\n", res.InsertedID)
+	}
+	return err
+}
+
+func (r *clientsRepository) GetById(id string) (client *models.Client, err error) {
+	err = r.coll.FindOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: id}},
+	).Decode(&client)
+	return client, err
+}
+
+func (r *clientsRepository) GetByOwner(owner string) (clients []*models.Client, err error) {
+	cursor, err := r.coll.Find(context.TODO(), bson.D{{Key: "owner", Value: owner}})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.TODO(), &clients)
+	return clients, err
+}
+
+// UpdateAccess stores the scopes and introspection access an administrator
+// granted to client
+func (r *clientsRepository) UpdateAccess(client *models.Client) error {
+	res, err := r.coll.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: client.Id}},
+		bson.D{{
+			Key: "$set",
+			Value: bson.D{
+				{Key: "scopes", Value: client.Scopes},
+				{Key: "resource_server", Value: client.ResourceServer},
+				{Key: "updated_at", Value: client.UpdatedAt},
+			},
+		}})
+	if res != nil {
+		log.Printf("Updated access of client: %s\n", client.Id)
+	}
+	return err
+}
+
+func (r *clientsRepository) Delete(id string) error {
+	_, err := r.coll.DeleteOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: id}},
+	)
+	log.Printf("Deleted client: %s\n", id)
+	return err
+}
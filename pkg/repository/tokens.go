@@ -2,22 +2,139 @@ package repository
 
 import (
 	"github.com/mixedmachine/user-auth-server/pkg/db"
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
 
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
-const experationTime = 15 // minutes
+const (
+	refreshExpirationTime = 30 * 24 // hours
+	codeExpirationTime    = 5       // minutes
+	resetExpirationTime   = 15      // minutes
+	verifyExpirationTime  = 24      // hours
+	verifyResendInterval  = 1       // minutes
+	mfaExpirationTime     = 5       // minutes
+	enrollExpirationTime  = 10      // minutes
+	magicExpirationTime   = 10      // minutes
+	magicResendInterval   = 1       // minutes
+
+	// mfaMaxAttempts is how many codes can be tried against one MFA challenge
+	mfaMaxAttempts = 5
+	// magicCodeMaxAttempts is how many guesses one emailed sign in code takes
+	magicCodeMaxAttempts = 5
+
+	refreshKeyPrefix  = "refresh:"
+	familyKeyPrefix   = "family:"
+	sessionKeyPrefix  = "session:"
+	userKeyPrefix     = "user-sessions:"
+	codeKeyPrefix     = "code:"
+	resetKeyPrefix    = "reset:"
+	userResetPrefix   = "user-resets:"
+	verifyKeyPrefix   = "verify-sent:"
+	verifyTokenPrefix = "verify:"
+	mfaKeyPrefix      = "mfa:"
+	enrollKeyPrefix   = "totp-enroll:"
+	webauthnPrefix    = "webauthn:"
+	magicLinkPrefix   = "magic-link:"
+	magicCodePrefix   = "magic-code:"
+	magicSentPrefix   = "magic-sent:"
+	loginFailPrefix   = "login-failures:"
+	loginDelayPrefix  = "login-delay:"
+	loginLockPrefix   = "login-lock:"
+)
+
+// useRefreshScript atomically counts a use of a refresh token and returns its
+// fields, or nil when the token does not exist
+var useRefreshScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return nil
+end
+redis.call("HINCRBY", KEYS[1], "uses", 1)
+return redis.call("HGETALL", KEYS[1])
+`)
+
+// useMFAScript atomically counts an attempt against an MFA challenge and
+// returns its user, or nil when the challenge does not exist or ran out of
+// attempts, in which case it is deleted
+var useMFAScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return nil
+end
+if redis.call("HINCRBY", KEYS[1], "attempts", 1) > tonumber(ARGV[1]) then
+	redis.call("DEL", KEYS[1])
+	return nil
+end
+return redis.call("HGET", KEYS[1], "user")
+`)
+
+// useMagicCodeScript atomically counts a guess of an emailed sign in code.
+// A right guess deletes the code and returns the address it was sent to, a
+// wrong one returns false and the last allowed wrong guess deletes the code
+// as well.
+var useMagicCodeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+if redis.call("HGET", KEYS[1], "code") == ARGV[1] then
+	local email = redis.call("HGET", KEYS[1], "email")
+	redis.call("DEL", KEYS[1])
+	return email
+end
+if redis.call("HINCRBY", KEYS[1], "attempts", 1) >= tonumber(ARGV[2]) then
+	redis.call("DEL", KEYS[1])
+end
+return false
+`)
 
 // TokenRepository is an interface for token repository
 type TokenRepository interface {
 	Create(token, user string, expire bool) error
 	Retrieve(token string) (string, error)
 	Delete(token string) error
+	CreateRefresh(token, accessToken string, refresh *models.RefreshToken) error
+	UseRefresh(token string) (*models.RefreshToken, error)
+	RetrieveRefresh(token string) (*models.RefreshToken, error)
+	RevokeFamily(family string) error
+	RevokeUser(user string) error
+	TouchSession(session *models.Session) error
+	GetSession(id string) (*models.Session, error)
+	GetSessions(user string) ([]*models.Session, error)
+	CreateCode(code string, grant *models.AuthorizationCode) error
+	ConsumeCode(code string) (*models.AuthorizationCode, error)
+	CreateResetToken(token, user string) error
+	RetrieveResetToken(token string) (string, error)
+	ConsumeResetToken(token string) (string, error)
+	RevokeResetTokens(user string) error
+	CreateVerificationToken(token, user, email string) error
+	ConsumeVerificationToken(token string) (string, string, error)
+	ThrottleVerification(email string) (time.Duration, error)
+	CreateMFAChallenge(token, user string) error
+	RetrieveMFAChallenge(token string) (string, error)
+	UseMFAChallenge(token string) (string, error)
+	DeleteMFAChallenge(token string) error
+	CreateTOTPEnrollment(user, secret string) error
+	RetrieveTOTPEnrollment(user string) (string, error)
+	DeleteTOTPEnrollment(user string) error
+	CreateWebAuthnSession(session *models.WebAuthnSession) error
+	ConsumeWebAuthnSession(challenge string) (*models.WebAuthnSession, error)
+	CreateMagicLink(token, user, email string) error
+	ConsumeMagicLink(token string) (string, string, error)
+	CreateSignInCode(user, email, code string) error
+	UseSignInCode(user, code string) (string, error)
+	ThrottleMagicSignIn(email string) (time.Duration, error)
+	LoginWait(account, ip string) (time.Duration, error)
+	FailLogin(account, ip string) error
+	ClearLoginFailures(account string) error
 }
 
 // tokensRepository is a struct for token repository
@@ -35,20 +152,17 @@ func NewTokenRepository(conn db.RedisConnection) TokenRepository {
 }
 
 // Create creates a new token for user in the database with an option to expire
-// the token after a certain amount of time
+// the token together with its signature, after security.AccessTokenLifetime
 func (r *tokensRepository) Create(token, user string, expire bool) error {
-	exp := 0
+	var exp time.Duration
 	exp_str := "never"
 
 	if expire {
-		exp = experationTime
-		exp_str = fmt.Sprintf("in %d minutes", experationTime)
+		exp = security.AccessTokenLifetime
+		exp_str = fmt.Sprintf("in %v", exp)
 	}
 
-	err := r.rClient.Set(
-		token, user,
-		time.Duration(exp)*time.Minute,
-	).Err()
+	err := r.rClient.Set(token, user, exp).Err()
 
 	if err != nil {
 		return err
@@ -77,3 +191,678 @@ func (r *tokensRepository) Delete(token string) error {
 	log.Printf("Deleted token\n")
 	return nil
 }
+
+// CreateRefresh stores a hashed refresh token and records it, together with
+// the access token issued alongside it, as a member of the token family. The
+// family is indexed under its user as a session.
+func (r *tokensRepository) CreateRefresh(token, accessToken string, refresh *models.RefreshToken) error {
+	key := refreshKeyPrefix + security.HashToken(token)
+	familyKey := familyKeyPrefix + refresh.Family
+	exp := time.Duration(refreshExpirationTime) * time.Hour
+
+	pipe := r.rClient.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"user":      refresh.User,
+		"family":    refresh.Family,
+		"client_id": refresh.ClientId,
+		"scope":     refresh.Scope,
+		"uses":      0,
+	})
+	pipe.Expire(key, exp)
+	pipe.SAdd(familyKey, key, accessToken)
+	pipe.Expire(familyKey, exp)
+	pipe.SAdd(userKeyPrefix+refresh.User, refresh.Family)
+	pipe.Expire(userKeyPrefix+refresh.User, exp)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created refresh token for user %s in family %s\n", refresh.User, refresh.Family)
+
+	return nil
+}
+
+// UseRefresh marks a refresh token as used and returns its state. Presenting a
+// token that was already used returns util.ErrRefreshTokenReused along with the
+// token state so the caller can revoke its family.
+func (r *tokensRepository) UseRefresh(token string) (*models.RefreshToken, error) {
+	key := refreshKeyPrefix + security.HashToken(token)
+	res, err := useRefreshScript.Run(r.rClient, []string{key}).Result()
+	if err == redis.Nil {
+		return nil, util.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok {
+		return nil, util.ErrInvalidRefreshToken
+	}
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		fields[field] = value
+	}
+	refresh := parseRefresh(fields)
+
+	if refresh.Uses > 1 {
+		return refresh, util.ErrRefreshTokenReused
+	}
+	return refresh, nil
+}
+
+// RetrieveRefresh returns the state of a refresh token without using it
+func (r *tokensRepository) RetrieveRefresh(token string) (*models.RefreshToken, error) {
+	fields, err := r.rClient.HGetAll(refreshKeyPrefix + security.HashToken(token)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, util.ErrInvalidRefreshToken
+	}
+	return parseRefresh(fields), nil
+}
+
+// RevokeFamily deletes every refresh and access token issued in a token family
+// and the session it belongs to
+func (r *tokensRepository) RevokeFamily(family string) error {
+	familyKey := familyKeyPrefix + family
+	sessionKey := sessionKeyPrefix + family
+	members, err := r.rClient.SMembers(familyKey).Result()
+	if err != nil {
+		return err
+	}
+	user, err := r.rClient.HGet(sessionKey, "user").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	pipe := r.rClient.TxPipeline()
+	pipe.Del(append(members, familyKey, sessionKey)...)
+	if user != "" {
+		pipe.SRem(userKeyPrefix+user, family)
+	}
+	_, err = pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked token family %s\n", family)
+	return nil
+}
+
+// RevokeUser deletes every session and token family belonging to a user
+func (r *tokensRepository) RevokeUser(user string) error {
+	userKey := userKeyPrefix + user
+	families, err := r.rClient.SMembers(userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		err = r.RevokeFamily(family)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = r.rClient.Del(userKey).Err()
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked all tokens for user %s\n", user)
+	return nil
+}
+
+// TouchSession records that a session was used, and from where. The session
+// is created on first use and expires with its token family.
+func (r *tokensRepository) TouchSession(session *models.Session) error {
+	key := sessionKeyPrefix + session.Id
+	exp := time.Duration(refreshExpirationTime) * time.Hour
+	now := time.Now().Unix()
+
+	pipe := r.rClient.TxPipeline()
+	pipe.HSetNX(key, "created_at", now)
+	pipe.HMSet(key, map[string]interface{}{
+		"user":         session.User,
+		"client_id":    session.ClientId,
+		"ip":           session.IP,
+		"user_agent":   session.UserAgent,
+		"last_used_at": now,
+	})
+	pipe.Expire(key, exp)
+	pipe.SAdd(userKeyPrefix+session.User, session.Id)
+	pipe.Expire(userKeyPrefix+session.User, exp)
+	_, err := pipe.Exec()
+	return err
+}
+
+// GetSession retrieves a session by id
+func (r *tokensRepository) GetSession(id string) (*models.Session, error) {
+	fields, err := r.rClient.HGetAll(sessionKeyPrefix + id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, util.ErrSessionNotFound
+	}
+	return parseSession(id, fields), nil
+}
+
+// GetSessions returns the active sessions of a user, most recently used first.
+// Sessions that expired since they were indexed are dropped from the index.
+func (r *tokensRepository) GetSessions(user string) ([]*models.Session, error) {
+	userKey := userKeyPrefix + user
+	ids, err := r.rClient.SMembers(userKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*models.Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := r.GetSession(id)
+		if err == util.ErrSessionNotFound {
+			r.rClient.SRem(userKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// CreateCode stores an authorization code grant until it is exchanged or expires
+func (r *tokensRepository) CreateCode(code string, grant *models.AuthorizationCode) error {
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	err = r.rClient.Set(
+		codeKeyPrefix+security.HashToken(code), data,
+		time.Duration(codeExpirationTime)*time.Minute,
+	).Err()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created authorization code for user %s and client %s\n", grant.User, grant.ClientId)
+
+	return nil
+}
+
+// ConsumeCode retrieves and deletes an authorization code in one step so the
+// code can only ever be exchanged once
+func (r *tokensRepository) ConsumeCode(code string) (*models.AuthorizationCode, error) {
+	key := codeKeyPrefix + security.HashToken(code)
+
+	pipe := r.rClient.TxPipeline()
+	get := pipe.Get(key)
+	pipe.Del(key)
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return nil, util.ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var grant models.AuthorizationCode
+	err = json.Unmarshal([]byte(get.Val()), &grant)
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// CreateResetToken stores a hashed password reset token for user until it is
+// used or expires, and remembers it among the user's reset tokens
+func (r *tokensRepository) CreateResetToken(token, user string) error {
+	hash := security.HashToken(token)
+	exp := time.Duration(resetExpirationTime) * time.Minute
+
+	pipe := r.rClient.TxPipeline()
+	pipe.Set(resetKeyPrefix+hash, user, exp)
+	pipe.SAdd(userResetPrefix+user, hash)
+	pipe.Expire(userResetPrefix+user, exp)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created password reset token for user %s\n", user)
+	return nil
+}
+
+// RetrieveResetToken returns the user a password reset token was issued to
+// without using it up
+func (r *tokensRepository) RetrieveResetToken(token string) (string, error) {
+	user, err := r.rClient.Get(resetKeyPrefix + security.HashToken(token)).Result()
+	if err == redis.Nil {
+		return "", util.ErrInvalidResetToken
+	}
+	return user, err
+}
+
+// ConsumeResetToken retrieves and deletes a password reset token in one step
+// so it can only ever be used once
+func (r *tokensRepository) ConsumeResetToken(token string) (string, error) {
+	key := resetKeyPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	get := pipe.Get(key)
+	pipe.Del(key)
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return "", util.ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return get.Val(), nil
+}
+
+// RevokeResetTokens deletes every password reset token issued to user, so
+// links still sitting in their mailbox stop working once one was used
+func (r *tokensRepository) RevokeResetTokens(user string) error {
+	userKey := userResetPrefix + user
+	hashes, err := r.rClient.SMembers(userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userKey}
+	for _, hash := range hashes {
+		keys = append(keys, resetKeyPrefix+hash)
+	}
+	err = r.rClient.Del(keys...).Err()
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked all password reset tokens for user %s\n", user)
+	return nil
+}
+
+// CreateVerificationToken stores a hashed email verification token for the
+// address user has until it is used or expires
+func (r *tokensRepository) CreateVerificationToken(token, user, email string) error {
+	key := verifyTokenPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"user":  user,
+		"email": email,
+	})
+	pipe.Expire(key, time.Duration(verifyExpirationTime)*time.Hour)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created email verification token for user %s\n", user)
+	return nil
+}
+
+// ConsumeVerificationToken retrieves and deletes an email verification token
+// in one step so it can only ever be used once. It returns the user and the
+// address the token was issued for.
+func (r *tokensRepository) ConsumeVerificationToken(token string) (string, string, error) {
+	key := verifyTokenPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	get := pipe.HGetAll(key)
+	pipe.Del(key)
+	_, err := pipe.Exec()
+	if err != nil {
+		return "", "", err
+	}
+	fields := get.Val()
+	if fields["user"] == "" {
+		return "", "", util.ErrInvalidVerificationToken
+	}
+	return fields["user"], fields["email"], nil
+}
+
+// ThrottleVerification claims the right to send a verification email to the
+// address. When one was already sent within the resend interval it returns
+// how long is left to wait instead.
+func (r *tokensRepository) ThrottleVerification(email string) (time.Duration, error) {
+	return r.throttle(
+		verifyKeyPrefix+security.HashToken(email),
+		time.Duration(verifyResendInterval)*time.Minute,
+	)
+}
+
+// throttle claims key for interval, or returns how long is left until the
+// key can be claimed again
+func (r *tokensRepository) throttle(key string, interval time.Duration) (time.Duration, error) {
+	claimed, err := r.rClient.SetNX(key, 1, interval).Result()
+	if err != nil || claimed {
+		return 0, err
+	}
+	wait, err := r.rClient.TTL(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if wait <= 0 {
+		wait = interval
+	}
+	return wait, nil
+}
+
+// CreateMFAChallenge stores a hashed MFA challenge token for a user who
+// passed the first factor
+func (r *tokensRepository) CreateMFAChallenge(token, user string) error {
+	key := mfaKeyPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"user":     user,
+		"attempts": 0,
+	})
+	pipe.Expire(key, time.Duration(mfaExpirationTime)*time.Minute)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created MFA challenge for user %s\n", user)
+	return nil
+}
+
+// RetrieveMFAChallenge returns the user an MFA challenge was issued to
+// without counting an attempt
+func (r *tokensRepository) RetrieveMFAChallenge(token string) (string, error) {
+	user, err := r.rClient.HGet(mfaKeyPrefix+security.HashToken(token), "user").Result()
+	if err == redis.Nil {
+		return "", util.ErrInvalidMFAToken
+	}
+	return user, err
+}
+
+// UseMFAChallenge counts an attempt to answer an MFA challenge and returns
+// the user it was issued to. The challenge is gone once its attempts ran out.
+func (r *tokensRepository) UseMFAChallenge(token string) (string, error) {
+	res, err := useMFAScript.Run(
+		r.rClient,
+		[]string{mfaKeyPrefix + security.HashToken(token)},
+		mfaMaxAttempts,
+	).Result()
+	if err == redis.Nil {
+		return "", util.ErrInvalidMFAToken
+	}
+	if err != nil {
+		return "", err
+	}
+	user, _ := res.(string)
+	return user, nil
+}
+
+// DeleteMFAChallenge removes an MFA challenge once it was answered
+func (r *tokensRepository) DeleteMFAChallenge(token string) error {
+	return r.rClient.Del(mfaKeyPrefix + security.HashToken(token)).Err()
+}
+
+// CreateTOTPEnrollment keeps the secret of an authenticator the user is
+// enrolling until the enrollment is confirmed or expires
+func (r *tokensRepository) CreateTOTPEnrollment(user, secret string) error {
+	return r.rClient.Set(
+		enrollKeyPrefix+user, secret,
+		time.Duration(enrollExpirationTime)*time.Minute,
+	).Err()
+}
+
+// RetrieveTOTPEnrollment returns the secret of the user's pending enrollment
+func (r *tokensRepository) RetrieveTOTPEnrollment(user string) (string, error) {
+	secret, err := r.rClient.Get(enrollKeyPrefix + user).Result()
+	if err == redis.Nil {
+		return "", util.ErrNoMFAEnrollment
+	}
+	return secret, err
+}
+
+// DeleteTOTPEnrollment removes the user's pending enrollment
+func (r *tokensRepository) DeleteTOTPEnrollment(user string) error {
+	return r.rClient.Del(enrollKeyPrefix + user).Err()
+}
+
+// CreateWebAuthnSession keeps a WebAuthn ceremony until the authenticator's
+// response arrives or it times out
+func (r *tokensRepository) CreateWebAuthnSession(session *models.WebAuthnSession) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return r.rClient.Set(
+		webauthnPrefix+security.HashToken(session.Challenge), value,
+		security.WebAuthnTimeout,
+	).Err()
+}
+
+// ConsumeWebAuthnSession retrieves and deletes the ceremony of a challenge in
+// one step, so every challenge is answered only once
+func (r *tokensRepository) ConsumeWebAuthnSession(challenge string) (*models.WebAuthnSession, error) {
+	key := webauthnPrefix + security.HashToken(challenge)
+
+	pipe := r.rClient.TxPipeline()
+	get := pipe.Get(key)
+	pipe.Del(key)
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return nil, util.ErrInvalidWebAuthnChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session models.WebAuthnSession
+	err = json.Unmarshal([]byte(get.Val()), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// CreateMagicLink stores a hashed sign in link token for user, sent to email,
+// until it is used or expires
+func (r *tokensRepository) CreateMagicLink(token, user, email string) error {
+	key := magicLinkPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"user":  user,
+		"email": email,
+	})
+	pipe.Expire(key, time.Duration(magicExpirationTime)*time.Minute)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created sign in link for user %s\n", user)
+	return nil
+}
+
+// ConsumeMagicLink retrieves and deletes a sign in link token in one step so
+// it can only ever be used once. It returns the user and the address the
+// link was sent to.
+func (r *tokensRepository) ConsumeMagicLink(token string) (string, string, error) {
+	key := magicLinkPrefix + security.HashToken(token)
+
+	pipe := r.rClient.TxPipeline()
+	get := pipe.HGetAll(key)
+	pipe.Del(key)
+	_, err := pipe.Exec()
+	if err != nil {
+		return "", "", err
+	}
+	fields := get.Val()
+	if fields["user"] == "" {
+		return "", "", util.ErrInvalidMagicLink
+	}
+	return fields["user"], fields["email"], nil
+}
+
+// CreateSignInCode stores the keyed hash of a sign in code emailed to user at
+// email. A user has one code at a time, so a new code replaces the last one.
+func (r *tokensRepository) CreateSignInCode(user, email, code string) error {
+	key := magicCodePrefix + user
+
+	pipe := r.rClient.TxPipeline()
+	pipe.Del(key)
+	pipe.HMSet(key, map[string]interface{}{
+		"code":     security.HashOneTimeCode(code),
+		"email":    email,
+		"attempts": 0,
+	})
+	pipe.Expire(key, time.Duration(magicExpirationTime)*time.Minute)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created sign in code for user %s\n", user)
+	return nil
+}
+
+// UseSignInCode checks a guess of the user's sign in code and returns the
+// address it was sent to. The code is gone once it was guessed right or its
+// attempts ran out.
+func (r *tokensRepository) UseSignInCode(user, code string) (string, error) {
+	res, err := useMagicCodeScript.Run(
+		r.rClient,
+		[]string{magicCodePrefix + user},
+		security.HashOneTimeCode(code), magicCodeMaxAttempts,
+	).Result()
+	if err == redis.Nil {
+		return "", util.ErrInvalidSignInCode
+	}
+	if err != nil {
+		return "", err
+	}
+	email, ok := res.(string)
+	if !ok {
+		return "", util.ErrInvalidSignInCode
+	}
+	return email, nil
+}
+
+// ThrottleMagicSignIn claims the right to send a sign in email to the
+// address, or returns how long is left to wait
+func (r *tokensRepository) ThrottleMagicSignIn(email string) (time.Duration, error) {
+	return r.throttle(
+		magicSentPrefix+security.HashToken(email),
+		time.Duration(magicResendInterval)*time.Minute,
+	)
+}
+
+// LoginWait returns how long a sign in to account from ip has to wait,
+// because of a delay after failed attempts or a lockout of either
+func (r *tokensRepository) LoginWait(account, ip string) (time.Duration, error) {
+	pipe := r.rClient.Pipeline()
+	waits := []*redis.DurationCmd{
+		pipe.PTTL(loginDelayPrefix + loginAccountKey(account)),
+		pipe.PTTL(loginLockPrefix + loginAccountKey(account)),
+		pipe.PTTL(loginLockPrefix + loginIPKey(ip)),
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, cmd := range waits {
+		if cmd.Val() > wait {
+			wait = cmd.Val()
+		}
+	}
+	return wait, nil
+}
+
+// FailLogin counts a failed sign in to account from ip, and delays or locks
+// out further attempts as security.LoginThrottle says
+func (r *tokensRepository) FailLogin(account, ip string) error {
+	policy := security.LoginThrottle
+	for _, subject := range []struct {
+		key string
+		ip  bool
+	}{
+		{loginAccountKey(account), false},
+		{loginIPKey(ip), true},
+	} {
+		pipe := r.rClient.TxPipeline()
+		incr := pipe.Incr(loginFailPrefix + subject.key)
+		pipe.Expire(loginFailPrefix+subject.key, policy.Window)
+		_, err := pipe.Exec()
+		if err != nil {
+			return err
+		}
+		failures := int(incr.Val())
+
+		if policy.Locked(failures, subject.ip) {
+			// The lockout takes over, and counting starts over once it ends
+			pipe := r.rClient.TxPipeline()
+			pipe.Set(loginLockPrefix+subject.key, 1, policy.LockoutDuration)
+			pipe.Del(loginFailPrefix+subject.key, loginDelayPrefix+subject.key)
+			_, err = pipe.Exec()
+			if err != nil {
+				return err
+			}
+			log.Printf("Locked out sign ins of %s for %v after %d failures\n", subject.key, policy.LockoutDuration, failures)
+			continue
+		}
+		// Shared addresses would slow down everyone behind them, so only
+		// accounts are delayed
+		if delay := policy.Delay(failures); delay > 0 && !subject.ip {
+			err = r.rClient.Set(loginDelayPrefix+subject.key, 1, delay).Err()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failed sign ins of account and lifts its
+// delay or lockout, after a successful sign in or when an admin unlocks it
+func (r *tokensRepository) ClearLoginFailures(account string) error {
+	key := loginAccountKey(account)
+	return r.rClient.Del(loginFailPrefix+key, loginDelayPrefix+key, loginLockPrefix+key).Err()
+}
+
+// loginAccountKey names the sign in counters of an account by its hashed
+// address. Addresses without an account are counted the same way, so being
+// throttled never tells whether an account exists.
+func loginAccountKey(account string) string {
+	return "account:" + security.HashToken(account)
+}
+
+// loginIPKey names the sign in counters of a source IP
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// parseRefresh builds the refresh token state from its stored hash fields
+func parseRefresh(fields map[string]string) *models.RefreshToken {
+	uses, _ := strconv.ParseInt(fields["uses"], 10, 64)
+	return &models.RefreshToken{
+		User:     fields["user"],
+		Family:   fields["family"],
+		ClientId: fields["client_id"],
+		Scope:    fields["scope"],
+		Uses:     uses,
+	}
+}
+
+// parseSession builds a session from its stored hash fields
+func parseSession(id string, fields map[string]string) *models.Session {
+	created, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastUsed, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+	return &models.Session{
+		Id:         id,
+		User:       fields["user"],
+		ClientId:   fields["client_id"],
+		IP:         fields["ip"],
+		UserAgent:  fields["user_agent"],
+		CreatedAt:  time.Unix(created, 0),
+		LastUsedAt: time.Unix(lastUsed, 0),
+	}
+}
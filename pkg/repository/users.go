@@ -4,24 +4,71 @@ import (
 	"github.com/mixedmachine/user-auth-server/pkg/db"
 	"github.com/mixedmachine/user-auth-server/pkg/models"
 
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const UserCollection = "users"
 
+const (
+	DefaultUsersLimit = 20
+	MaxUsersLimit     = 100
+)
+
+// userSortFields are the fields users can be listed by
+var userSortFields = map[string]bool{
+	"created_at": true,
+	"email":      true,
+	"name":       true,
+}
+
+// UserQuery selects a page of users. Sort is a field name, prefixed with "-"
+// for descending order, and After is the cursor returned with the previous page.
+type UserQuery struct {
+	Limit         int
+	After         string
+	Sort          string
+	EmailPrefix   string
+	Name          string
+	Admin         *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// userCursor is the position after the last user of a page
+type userCursor struct {
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
 type UsersRepository interface {
 	Save(user *models.User) error
 	Update(user *models.User) error
+	UpdateRoles(user *models.User) error
+	UpdateMFA(user *models.User) error
+	UseTOTPStep(id string, step int64) (bool, error)
+	UseRecoveryCode(id, hash string) (bool, error)
+	AddWebAuthnCredential(id string, credential *models.WebAuthnCredential) error
+	UpdateWebAuthnCredential(id string, credential *models.WebAuthnCredential) error
+	RemoveWebAuthnCredential(id, credentialId string) (bool, error)
+	GetByWebAuthnCredential(credentialId string) (user *models.User, err error)
 	GetById(id string) (user *models.User, err error)
 	GetByEmail(email string) (user *models.User, err error)
 	GetByName(name string) (user *models.User, err error)
 	GetByAdmin(admin bool) (users []*models.User, err error)
-	GetAll() (users []*models.User, err error)
+	List(query *UserQuery) (users []*models.User, next string, err error)
 	Delete(id string) error
 }
 
@@ -63,8 +110,12 @@ func (r *usersRepository) Update(user *models.User) error {
 		bson.D{{
 			Key: "$set",
 			Value: bson.D{
+				{Key: "name", Value: user.Name},
 				{Key: "email", Value: user.Email},
+				{Key: "email_verified", Value: user.EmailVerified},
 				{Key: "password", Value: user.Password},
+				{Key: "password_history", Value: user.PasswordHistory},
+				{Key: "password_changed_at", Value: user.PasswordChangedAt},
 				{Key: "updated_at", Value: user.UpdatedAt},
 			},
 		}})
@@ -74,6 +125,160 @@ func (r *usersRepository) Update(user *models.User) error {
 	return err
 }
 
+func (r *usersRepository) UpdateRoles(user *models.User) error {
+	res, err := r.coll.UpdateByID(
+		context.TODO(),
+		user.Id,
+		bson.D{{
+			Key: "$set",
+			Value: bson.D{
+				{Key: "admin", Value: user.Admin},
+				{Key: "roles", Value: user.Roles},
+				{Key: "permissions", Value: user.Permissions},
+				{Key: "updated_at", Value: user.UpdatedAt},
+			},
+		}})
+	if res != nil {
+		log.Printf("Updated roles of user: %v\n", user.Id.Hex())
+	}
+	return err
+}
+
+// UpdateMFA stores the second factors of user, removing the ones that are unset
+func (r *usersRepository) UpdateMFA(user *models.User) error {
+	set := bson.D{{Key: "updated_at", Value: user.UpdatedAt}}
+	unset := bson.D{}
+	for _, field := range []struct {
+		key   string
+		value interface{}
+		empty bool
+	}{
+		{"totp_secret", user.TOTPSecret, user.TOTPSecret == ""},
+		{"totp_last_step", user.TOTPLastStep, user.TOTPLastStep == 0},
+		{"recovery_codes", user.RecoveryCodes, len(user.RecoveryCodes) == 0},
+	} {
+		if field.empty {
+			unset = append(unset, bson.E{Key: field.key, Value: ""})
+		} else {
+			set = append(set, bson.E{Key: field.key, Value: field.value})
+		}
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	res, err := r.coll.UpdateByID(context.TODO(), user.Id, update)
+	if res != nil {
+		log.Printf("Updated second factors of user: %v\n", user.Id.Hex())
+	}
+	return err
+}
+
+// UseTOTPStep records that a TOTP code of step was accepted for the user. It
+// reports false when a code of this or a later step was accepted before, so
+// every code works only once.
+func (r *usersRepository) UseTOTPStep(id string, step int64) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.coll.UpdateOne(
+		context.TODO(),
+		bson.D{
+			{Key: "_id", Value: _id},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "totp_last_step", Value: bson.D{{Key: "$lt", Value: step}}}},
+				bson.D{{Key: "totp_last_step", Value: bson.D{{Key: "$exists", Value: false}}}},
+			}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "totp_last_step", Value: step}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UseRecoveryCode removes a recovery code hash from the user. It reports
+// false when the hash was already removed, so every code works only once.
+func (r *usersRepository) UseRecoveryCode(id, hash string) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.coll.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: _id}, {Key: "recovery_codes", Value: hash}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "recovery_codes", Value: hash}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// AddWebAuthnCredential registers a credential to the user
+func (r *usersRepository) AddWebAuthnCredential(id string, credential *models.WebAuthnCredential) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	res, err := r.coll.UpdateByID(
+		context.TODO(),
+		_id,
+		bson.D{{Key: "$push", Value: bson.D{{Key: "webauthn_credentials", Value: credential}}}},
+	)
+	if res != nil {
+		log.Printf("Registered webauthn credential of user: %v\n", id)
+	}
+	return err
+}
+
+// UpdateWebAuthnCredential stores the signature counter and last use of a
+// credential of the user
+func (r *usersRepository) UpdateWebAuthnCredential(id string, credential *models.WebAuthnCredential) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	_, err = r.coll.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: _id}, {Key: "webauthn_credentials.id", Value: credential.Id}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "webauthn_credentials.$.sign_count", Value: credential.SignCount},
+			{Key: "webauthn_credentials.$.last_used_at", Value: credential.LastUsedAt},
+		}}},
+	)
+	return err
+}
+
+// RemoveWebAuthnCredential removes a credential from the user, reporting
+// false when the user has no such credential
+func (r *usersRepository) RemoveWebAuthnCredential(id, credentialId string) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.coll.UpdateOne(
+		context.TODO(),
+		bson.D{{Key: "_id", Value: _id}, {Key: "webauthn_credentials.id", Value: credentialId}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "webauthn_credentials", Value: bson.D{{Key: "id", Value: credentialId}}}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// GetByWebAuthnCredential returns the user a credential is registered to
+func (r *usersRepository) GetByWebAuthnCredential(credentialId string) (user *models.User, err error) {
+	err = r.coll.FindOne(
+		context.TODO(),
+		bson.D{{Key: "webauthn_credentials.id", Value: credentialId}},
+	).Decode(&user)
+	return user, err
+}
+
 func (r *usersRepository) GetById(id string) (user *models.User, err error) {
 	_id, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -112,14 +317,75 @@ func (r *usersRepository) GetByAdmin(admin bool) (users []*models.User, err erro
 	return users, err
 }
 
-func (r *usersRepository) GetAll() (users []*models.User, err error) {
-	cursor, err := r.coll.Find(context.TODO(), bson.M{})
-	if err != nil {
-		return nil, err
+// List returns a page of users matching query, without their password
+// hashes, and the cursor of the next page or "" on the last page
+func (r *usersRepository) List(query *UserQuery) (users []*models.User, next string, err error) {
+	field, order := query.Sort, 1
+	if strings.HasPrefix(field, "-") {
+		field, order = field[1:], -1
+	}
+	if field == "" {
+		field = "created_at"
+	}
+	if !userSortFields[field] {
+		return nil, "", util.ErrInvalidSort
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultUsersLimit
+	}
+	if limit > MaxUsersLimit {
+		limit = MaxUsersLimit
+	}
+
+	filter := bson.D{}
+	if query.EmailPrefix != "" {
+		filter = append(filter, bson.E{Key: "email", Value: primitive.Regex{
+			Pattern: "^" + regexp.QuoteMeta(util.NormalizeEmail(query.EmailPrefix)),
+		}})
+	}
+	if query.Name != "" {
+		filter = append(filter, bson.E{Key: "name", Value: query.Name})
+	}
+	if query.Admin != nil {
+		filter = append(filter, bson.E{Key: "admin", Value: *query.Admin})
+	}
+	created := bson.D{}
+	if !query.CreatedAfter.IsZero() {
+		created = append(created, bson.E{Key: "$gte", Value: query.CreatedAfter})
+	}
+	if !query.CreatedBefore.IsZero() {
+		created = append(created, bson.E{Key: "$lt", Value: query.CreatedBefore})
+	}
+	if len(created) > 0 {
+		filter = append(filter, bson.E{Key: "created_at", Value: created})
+	}
+	if query.After != "" {
+		after, err := cursorFilter(query.After, field, order)
+		if err != nil {
+			return nil, "", err
+		}
+		filter = append(filter, after)
 	}
 
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "password", Value: 0}}).
+		SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := r.coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
 	err = cursor.All(context.TODO(), &users)
-	return users, err
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(users) > limit {
+		users = users[:limit]
+		next = encodeCursor(users[limit-1], field)
+	}
+	return users, next, nil
 }
 
 func (r *usersRepository) Delete(id string) error {
@@ -134,3 +400,53 @@ func (r *usersRepository) Delete(id string) error {
 	log.Printf("Deleted user: %s\n", id)
 	return err
 }
+
+// encodeCursor returns the cursor pointing after user in a list sorted by field
+func encodeCursor(user *models.User, field string) string {
+	c := userCursor{Id: user.Id.Hex()}
+	switch field {
+	case "created_at":
+		c.Value = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "email":
+		c.Value = user.Email
+	case "name":
+		c.Value = user.Name
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorFilter matches the users that come after the cursor in a list sorted
+// by field, breaking ties on the id
+func cursorFilter(cursor, field string, order int) (bson.E, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return bson.E{}, util.ErrInvalidCursor
+	}
+	var c userCursor
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return bson.E{}, util.ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(c.Id)
+	if err != nil {
+		return bson.E{}, util.ErrInvalidCursor
+	}
+
+	var value interface{} = c.Value
+	if field == "created_at" {
+		value, err = time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return bson.E{}, util.ErrInvalidCursor
+		}
+	}
+
+	cmp := "$gt"
+	if order < 0 {
+		cmp = "$lt"
+	}
+	return bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: field, Value: bson.D{{Key: cmp, Value: value}}}},
+		bson.D{{Key: field, Value: value}, {Key: "_id", Value: bson.D{{Key: cmp, Value: id}}}},
+	}}, nil
+}
@@ -16,7 +16,7 @@ type Routes interface {
 
 func AuthRequired(ctx *fiber.Ctx) error {
 	return jwtware.New(jwtware.Config{
-		SigningKey:    security.JwtSecretKey,
+		SigningKeys:   security.Keys.VerificationKeys(),
 		SigningMethod: security.JwtSigningMethod,
 		TokenLookup:   "header:Authorization",
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/controllers"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type oauthRoutes struct {
+	oauthController controllers.OAuthController
+	guard           PermissionGuard
+	limiter         RateLimiter
+}
+
+func NewOAuthRoutes(oauthController controllers.OAuthController, guard PermissionGuard, limiter RateLimiter) Routes {
+	return &oauthRoutes{
+		oauthController: oauthController,
+		guard:           guard,
+		limiter:         limiter,
+	}
+}
+
+func (r *oauthRoutes) Install(app *fiber.App) {
+	// OpenID Connect
+	app.Get("/.well-known/openid-configuration", r.oauthController.Discovery)
+	app.Get("/userinfo", r.oauthController.UserInfo)
+	app.Post("/userinfo", r.oauthController.UserInfo)
+
+	oauth := app.Group("/oauth", r.limiter.Limit(RateLimitAPI))
+
+	// Client registration
+	oauth.Post("/clients", r.oauthController.RegisterClient)
+	oauth.Get("/clients", r.oauthController.GetClients)
+	oauth.Delete("/clients/:id", r.oauthController.DeleteClient)
+	oauth.Put("/clients/:id/access", r.guard.Require(security.PermClientsWrite), r.oauthController.UpdateClientAccess)
+
+	// Authorization code flow
+	oauth.Get("/authorize", r.oauthController.Authorize)
+	oauth.Post("/authorize", r.oauthController.Consent)
+	oauth.Post("/token", r.limiter.Limit(RateLimitRefresh), r.oauthController.Token)
+	oauth.Post("/introspect", r.oauthController.Introspect)
+	oauth.Post("/revoke", r.oauthController.Revoke)
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/controllers"
+	"github.com/mixedmachine/user-auth-server/pkg/repository"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PermissionGuard builds middleware that only lets a request through when the
+// authenticated user holds a permission
+type PermissionGuard interface {
+	Require(perm security.Permission) fiber.Handler
+}
+
+type permissionGuard struct {
+	usersRepo  repository.UsersRepository
+	tokensRepo repository.TokenRepository
+}
+
+func NewPermissionGuard(repos map[string]interface{}) PermissionGuard {
+	return &permissionGuard{
+		usersRepo:  repos["users"].(repository.UsersRepository),
+		tokensRepo: repos["tokens"].(repository.TokenRepository),
+	}
+}
+
+// Require answers 401 to unauthenticated requests and 403 when the user lacks
+// perm. The user's roles are read on every request so changes apply at once.
+func (g *permissionGuard) Require(perm security.Permission) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		userId, err := controllers.AuthRequest(ctx, g.tokensRepo)
+		if err != nil {
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(err))
+		}
+		user, err := g.usersRepo.GetById(userId)
+		if err != nil {
+			return ctx.
+				Status(http.StatusUnauthorized).
+				JSON(util.NewJError(util.ErrUnauthorized))
+		}
+		if !security.HasPermission(user, perm) {
+			log.Printf("Require| %s lacks permission %s for %s %s\n", userId, perm, ctx.Method(), ctx.Path())
+			return ctx.
+				Status(http.StatusForbidden).
+				JSON(util.NewJError(util.ErrForbidden))
+		}
+		return ctx.Next()
+	}
+}
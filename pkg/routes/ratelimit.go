@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/controllers"
+	"github.com/mixedmachine/user-auth-server/pkg/db"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Route groups that are limited separately. Every group has its own counter
+// per client, so a request can count against more than one.
+const (
+	RateLimitAPI     = "api"
+	RateLimitSignUp  = "signup"
+	RateLimitSignIn  = "signin"
+	RateLimitRefresh = "refresh"
+	RateLimitEmail   = "email"
+
+	rateLimitKeyPrefix = "ratelimit:"
+
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+)
+
+// RateLimit allows Requests per client within any Window
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// defaultRateLimits apply to the groups not configured otherwise. Sign up and
+// endpoints that send email are the most expensive to abuse.
+var defaultRateLimits = map[string]RateLimit{
+	RateLimitAPI:     {Requests: 300, Window: time.Minute},
+	RateLimitSignUp:  {Requests: 5, Window: 10 * time.Minute},
+	RateLimitSignIn:  {Requests: 10, Window: time.Minute},
+	RateLimitRefresh: {Requests: 30, Window: time.Minute},
+	RateLimitEmail:   {Requests: 5, Window: 10 * time.Minute},
+}
+
+// slidingWindowScript counts a request against a sliding window made of the
+// current and the previous fixed window, the previous one weighted by how
+// much of it still overlaps. Both counts live in one hash along with the
+// index of the current window, which is told by the clock of Redis so every
+// replica of the server agrees on it. A request over the limit is not
+// counted, so clients recover as soon as they slow down. It returns whether
+// the request is allowed, both counts and how far into its window it is.
+var slidingWindowScript = redis.NewScript(`
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local index = math.floor(now / window)
+local elapsed = now % window
+local state = redis.call("HMGET", KEYS[1], "index", "current", "previous")
+local current, previous = 0, 0
+if tonumber(state[1]) == index then
+	current, previous = tonumber(state[2]), tonumber(state[3])
+elseif tonumber(state[1]) == index - 1 then
+	previous = tonumber(state[2])
+end
+if previous * (window - elapsed) / window + current >= limit then
+	return {0, previous, current, elapsed}
+end
+current = current + 1
+redis.call("HMSET", KEYS[1], "index", index, "current", current, "previous", previous)
+redis.call("PEXPIRE", KEYS[1], window * 2)
+return {1, previous, current, elapsed}
+`)
+
+// RateLimiter builds middleware that limits how often each client may call a
+// group of routes. State lives in Redis, so limits hold across replicas.
+type RateLimiter interface {
+	Limit(group string) fiber.Handler
+}
+
+type rateLimiter struct {
+	rClient  *redis.Client
+	limits   map[string]RateLimit
+	failOpen bool
+}
+
+// NewRateLimiter configures the limits from the environment. RATE_LIMIT_<GROUP>
+// sets a group's limit as requests per window, such as 10/1m, or turns it off
+// with 0. RATE_LIMIT_FAILURE_MODE decides what happens while Redis can't be
+// reached: open lets requests through, closed refuses them. It is open unless
+// set.
+func NewRateLimiter(conn db.RedisConnection) (RateLimiter, error) {
+	limiter := &rateLimiter{
+		rClient:  conn.DB(),
+		limits:   map[string]RateLimit{},
+		failOpen: true,
+	}
+	for group, limit := range defaultRateLimits {
+		if value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(group)); value != "" {
+			var err error
+			limit, err = parseRateLimit(value)
+			if err != nil {
+				return nil, fmt.Errorf("RATE_LIMIT_%s: %w", strings.ToUpper(group), err)
+			}
+		}
+		limiter.limits[group] = limit
+	}
+	switch mode := os.Getenv("RATE_LIMIT_FAILURE_MODE"); mode {
+	case "", "open":
+	case "closed":
+		limiter.failOpen = false
+	default:
+		return nil, fmt.Errorf("RATE_LIMIT_FAILURE_MODE: %w", util.ErrInvalidRateLimit)
+	}
+	return limiter, nil
+}
+
+// Limit counts every request to the group per client address and answers 429 with
+// Retry-After once the group's limit is reached. Responses carry the
+// RateLimit-* headers of the group.
+func (l *rateLimiter) Limit(group string) fiber.Handler {
+	limit, ok := l.limits[group]
+	if !ok {
+		panic(fmt.Sprintf("routes: unknown rate limit group %q", group))
+	}
+	if limit.Requests == 0 {
+		return func(ctx *fiber.Ctx) error {
+			return ctx.Next()
+		}
+	}
+	window := limit.Window.Milliseconds()
+
+	return func(ctx *fiber.Ctx) error {
+		res, err := slidingWindowScript.Run(
+			l.rClient,
+			[]string{rateLimitKeyPrefix + group + ":" + controllers.ClientIP(ctx)},
+			limit.Requests, window,
+		).Result()
+		values, _ := res.([]interface{})
+		if err == nil && len(values) != 4 {
+			err = util.ErrRateLimitUnavailable
+		}
+		if err != nil {
+			log.Printf("slidingWindowScript.Run| %s rate limit %s failed: %v\n", controllers.ClientIP(ctx), group, err.Error())
+			if l.failOpen {
+				return ctx.Next()
+			}
+			return ctx.
+				Status(http.StatusServiceUnavailable).
+				JSON(util.NewJError(util.ErrRateLimitUnavailable))
+		}
+		allowed, _ := values[0].(int64)
+		previous, _ := values[1].(int64)
+		current, _ := values[2].(int64)
+		elapsed, _ := values[3].(int64)
+
+		remaining := float64(limit.Requests) - float64(previous)*float64(window-elapsed)/float64(window) - float64(current)
+		ctx.Set(headerRateLimitLimit, strconv.Itoa(limit.Requests))
+		ctx.Set(headerRateLimitRemaining, strconv.Itoa(int(math.Max(0, math.Floor(remaining)))))
+		ctx.Set(headerRateLimitReset, strconv.Itoa(seconds(window-elapsed)))
+		ctx.Set(headerRateLimitPolicy, fmt.Sprintf("%d;w=%d", limit.Requests, seconds(window)))
+		if allowed == 1 {
+			return ctx.Next()
+		}
+
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds(retryAfter(limit.Requests, previous, current, window, elapsed))))
+		return ctx.
+			Status(http.StatusTooManyRequests).
+			JSON(util.NewJError(util.ErrRateLimited))
+	}
+}
+
+// retryAfter is how many milliseconds pass until the sliding window lets
+// another request through
+func retryAfter(limit int, previous, current, window, elapsed int64) int64 {
+	left := window - elapsed
+	if current >= int64(limit) {
+		// Only the current window's requests are left to slide out, once the
+		// next window begins
+		return left + int64(float64(window)*(1-float64(limit)/float64(current)))
+	}
+	if previous == 0 {
+		return 0
+	}
+	wait := left - int64(float64(int64(limit)-current)*float64(window)/float64(previous))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// seconds rounds milliseconds up to whole seconds, as the headers want them
+func seconds(ms int64) int {
+	return int(math.Ceil(float64(ms) / 1000))
+}
+
+// parseRateLimit reads a limit written as requests/window, or 0 for none
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "0" {
+		return RateLimit{}, nil
+	}
+	requests, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, util.ErrInvalidRateLimit
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return RateLimit{}, util.ErrInvalidRateLimit
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d < time.Second {
+		return RateLimit{}, util.ErrInvalidRateLimit
+	}
+	return RateLimit{Requests: n, Window: d}, nil
+}
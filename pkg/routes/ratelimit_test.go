@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RateLimit
+		ok    bool
+	}{
+		{"10/1m", RateLimit{Requests: 10, Window: time.Minute}, true},
+		{"5/10m", RateLimit{Requests: 5, Window: 10 * time.Minute}, true},
+		{"300/1s", RateLimit{Requests: 300, Window: time.Second}, true},
+		{"0", RateLimit{}, true},
+		{"", RateLimit{}, false},
+		{"10", RateLimit{}, false},
+		{"0/1m", RateLimit{}, false},
+		{"-1/1m", RateLimit{}, false},
+		{"ten/1m", RateLimit{}, false},
+		{"10/1", RateLimit{}, false},
+		{"10/500ms", RateLimit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.value)
+		if !tt.ok {
+			if !errors.Is(err, util.ErrInvalidRateLimit) {
+				t.Errorf("parseRateLimit(%q) error = %v, want %v", tt.value, err, util.ErrInvalidRateLimit)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	const window = int64(60000)
+	tests := []struct {
+		name              string
+		limit             int
+		previous, current int64
+		elapsed           int64
+		want              int64
+	}{
+		{"current window full", 10, 0, 10, 20000, 40000},
+		{"current window full with previous", 10, 30, 10, 20000, 40000},
+		{"current window over", 10, 0, 20, 20000, 70000},
+		{"previous window sliding out", 10, 20, 5, 30000, 15000},
+		{"previous window slid out enough", 10, 20, 5, 50000, 0},
+		{"nothing before", 10, 0, 5, 30000, 0},
+	}
+	for _, tt := range tests {
+		got := retryAfter(tt.limit, tt.previous, tt.current, window, tt.elapsed)
+		if got != tt.want {
+			t.Errorf("%s: retryAfter = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	tests := map[int64]int{0: 0, 1: 1, 999: 1, 1000: 1, 1001: 2, 60000: 60}
+	for ms, want := range tests {
+		if got := seconds(ms); got != want {
+			t.Errorf("seconds(%d) = %d, want %d", ms, got, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	_ "github.com/mixedmachine/user-auth-server/api"
 	"github.com/mixedmachine/user-auth-server/pkg/controllers"
+	"github.com/mixedmachine/user-auth-server/pkg/security"
 
 	"fmt"
 	"net/http"
@@ -17,35 +18,69 @@ const apiVersion = "v1"
 type authRoutes struct {
 	authController controllers.AuthController
 	userController controllers.UserController
+	guard          PermissionGuard
+	limiter        RateLimiter
 }
 
-func NewAuthRoutes(authController controllers.AuthController, userController controllers.UserController) Routes {
+func NewAuthRoutes(authController controllers.AuthController, userController controllers.UserController, guard PermissionGuard, limiter RateLimiter) Routes {
 	return &authRoutes{
 		authController: authController,
 		userController: userController,
+		guard:          guard,
+		limiter:        limiter,
 	}
 }
 
 func (r *authRoutes) Install(app *fiber.App) {
 	app.Get("/", serviceInfo)
 	app.Get("/swagger/*", swagger.HandlerDefault)
-	api := app.Group(fmt.Sprintf("/api/%s", apiVersion))
+	app.Get("/.well-known/jwks.json", r.authController.Jwks)
+	api := app.Group(fmt.Sprintf("/api/%s", apiVersion), r.limiter.Limit(RateLimitAPI))
+	signIn := r.limiter.Limit(RateLimitSignIn)
+	email := r.limiter.Limit(RateLimitEmail)
 
 	// Health check
 	api.Get("/ping", r.authController.Ping)
 
 	// Authentication
-	api.Post("/signup", r.authController.SignUp)
-	api.Post("/signin", r.authController.SignIn)
-	api.Post("/refresh", r.authController.RefreshToken)
+	api.Post("/signup", r.limiter.Limit(RateLimitSignUp), r.authController.SignUp)
+	api.Post("/signin", signIn, r.authController.SignIn)
+	api.Post("/signin/mfa", signIn, r.authController.SignInMFA)
+	api.Post("/signin/magic", email, r.authController.MagicSignIn)
+	api.Post("/signin/magic/verify", signIn, r.authController.VerifyMagicSignIn)
+	api.Post("/refresh", r.limiter.Limit(RateLimitRefresh), r.authController.RefreshToken)
+	api.Post("/signout", r.authController.SignOut)
+	api.Post("/password/forgot", email, r.authController.ForgotPassword)
+	api.Post("/password/reset", signIn, r.authController.ResetPassword)
+	api.Post("/email/verify", r.authController.VerifyEmail)
+	api.Post("/email/verify/resend", email, r.authController.ResendVerification)
 	api.Get("/auth", r.authController.Authenticator)
 
+	// Multi-factor authentication
+	mfaGroup := api.Group("/mfa")
+	mfaGroup.Post("/totp", r.authController.EnrollTOTP)
+	mfaGroup.Post("/totp/confirm", r.authController.ConfirmTOTP)
+	mfaGroup.Delete("/totp", r.authController.DisableTOTP)
+	mfaGroup.Post("/recovery-codes", r.authController.RegenerateRecoveryCodes)
+
+	// Passkeys and security keys
+	webauthnGroup := api.Group("/webauthn")
+	webauthnGroup.Post("/register/begin", r.authController.BeginWebAuthnRegistration)
+	webauthnGroup.Post("/register/finish", r.authController.FinishWebAuthnRegistration)
+	webauthnGroup.Post("/login/begin", r.authController.BeginWebAuthnLogin)
+	webauthnGroup.Post("/login/finish", signIn, r.authController.FinishWebAuthnLogin)
+	webauthnGroup.Post("/reauth/begin", r.authController.BeginWebAuthnReauthentication)
+	webauthnGroup.Get("/credentials", r.authController.GetWebAuthnCredentials)
+	webauthnGroup.Delete("/credentials/:id", r.authController.DeleteWebAuthnCredential)
+
 	// Users management
 	usersGroup := api.Group("/users")
-	usersGroup.Get("/", r.userController.GetUsers)
+	usersGroup.Get("/", r.guard.Require(security.PermUsersRead), r.userController.GetUsers)
 	usersGroup.Get("/:id", r.userController.GetUser)
 	usersGroup.Put("/:id", r.userController.PutUser)
 	usersGroup.Delete("/:id", r.userController.DeleteUser)
+	usersGroup.Put("/:id/roles", r.guard.Require(security.PermRolesWrite), r.userController.PutRoles)
+	usersGroup.Delete("/:id/lockout", r.guard.Require(security.PermUsersWrite), r.userController.UnlockUser)
 }
 
 // Service info
@@ -67,16 +102,51 @@ func serviceInfo(ctx *fiber.Ctx) error {
 			{Key: "version", Value: apiVersion},
 			{Key: "api_base_endpoint", Value: "/api/" + apiVersion},
 			{Key: "api_endpoints", Value: map[string]string{
-				"GET| /":                  "Service info",
-				"GET| <api>/ping":         "Health check",
-				"POST| <api>/signup":      "Create a new user",
-				"POST| <api>/signin":      "Sign in and get token",
-				"POST| <api>/refresh":     "Refresh token",
-				"GET| <api>/auth":         "Get user based on token",
-				"GET| <api>/users/":       "Get all users",
-				"GET| <api>/users/:id":    "Get user by id",
-				"PUT| <api>/users/:id":    "Update user by id",
-				"DELETE| <api>/users/:id": "Delete user by id",
+				"GET| /":                                 "Service info",
+				"GET| /.well-known/jwks.json":            "Token verification keys",
+				"GET| <api>/ping":                        "Health check",
+				"POST| <api>/signup":                     "Create a new user",
+				"POST| <api>/signin":                     "Sign in and get token",
+				"POST| <api>/signin/mfa":                 "Answer the MFA challenge of a sign in",
+				"POST| <api>/signin/magic":               "Request a sign in link or code by email",
+				"POST| <api>/signin/magic/verify":        "Sign in with an emailed link or code",
+				"POST| <api>/refresh":                    "Refresh token",
+				"POST| <api>/signout":                    "Sign out of one or every session",
+				"POST| <api>/password/forgot":            "Request a password reset link",
+				"POST| <api>/password/reset":             "Reset password with a reset token",
+				"POST| <api>/email/verify":               "Verify email with a verification token",
+				"POST| <api>/email/verify/resend":        "Request a new email verification link",
+				"GET| <api>/auth":                        "Get user based on token",
+				"POST| <api>/mfa/totp":                   "Start enrolling an authenticator",
+				"POST| <api>/mfa/totp/confirm":           "Confirm an authenticator and get recovery codes",
+				"DELETE| <api>/mfa/totp":                 "Disable the authenticator",
+				"POST| <api>/mfa/recovery-codes":         "Regenerate recovery codes",
+				"POST| <api>/webauthn/register/begin":    "Start registering a passkey",
+				"POST| <api>/webauthn/register/finish":   "Register a passkey",
+				"POST| <api>/webauthn/login/begin":       "Start signing in with a passkey",
+				"POST| <api>/webauthn/login/finish":      "Sign in with a passkey",
+				"POST| <api>/webauthn/reauth/begin":      "Start proving a second factor again with a passkey",
+				"GET| <api>/webauthn/credentials":        "List own passkeys",
+				"DELETE| <api>/webauthn/credentials/:id": "Delete own passkey by id",
+				"GET| <api>/users/":                      "Get all users (users:read)",
+				"GET| <api>/users/:id":                   "Get user by id",
+				"PUT| <api>/users/:id":                   "Update user by id",
+				"DELETE| <api>/users/:id":                "Delete user by id",
+				"PUT| <api>/users/:id/roles":             "Set the roles of a user by id",
+				"DELETE| <api>/users/:id/lockout":        "Lift the sign in lockout of a user by id (users:write)",
+				"GET| <api>/sessions/":                   "List own sessions",
+				"DELETE| <api>/sessions/:id":             "Revoke own session by id",
+				"POST| /oauth/clients":                   "Register an OAuth client",
+				"GET| /oauth/clients":                    "List own OAuth clients",
+				"DELETE| /oauth/clients/:id":             "Delete an OAuth client",
+				"PUT| /oauth/clients/:id/access":         "Grant scopes to an OAuth client (clients:write)",
+				"GET| /oauth/authorize":                  "OAuth authorization request",
+				"POST| /oauth/authorize":                 "OAuth consent decision",
+				"POST| /oauth/token":                     "OAuth token endpoint",
+				"POST| /oauth/introspect":                "OAuth token introspection",
+				"POST| /oauth/revoke":                    "OAuth token revocation",
+				"GET| /.well-known/openid-configuration": "OpenID Connect discovery",
+				"GET| /userinfo":                         "OpenID Connect userinfo",
 			}},
 		})
 }
@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/controllers"
+
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type sessionRoutes struct {
+	sessionController controllers.SessionController
+}
+
+func NewSessionRoutes(sessionController controllers.SessionController) Routes {
+	return &sessionRoutes{
+		sessionController: sessionController,
+	}
+}
+
+func (r *sessionRoutes) Install(app *fiber.App) {
+	sessions := app.Group(fmt.Sprintf("/api/%s/sessions", apiVersion))
+	sessions.Get("/", r.sessionController.GetSessions)
+	sessions.Delete("/:id", r.sessionController.DeleteSession)
+}
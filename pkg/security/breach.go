@@ -0,0 +1,478 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// bloomMagic starts every bloom filter file
+	bloomMagic = "BRCHBLM1"
+	// bloomChunkWords is how many words of a filter are encoded at once
+	bloomChunkWords = 1 << 16
+
+	// RangePrefixLen is how many hex digits of a hash name its range file
+	RangePrefixLen = 5
+	// corpusCheckLines is how many lines at the start of a corpus are checked
+	// on load, and corpusSamples how many more are sampled across a hash file
+	corpusCheckLines = 16
+	corpusSamples    = 64
+)
+
+// BreachChecker reports whether a password appears in a breach corpus
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// Breaches is checked against every new password when set
+var Breaches BreachChecker
+
+// InitBreachChecker loads the breach corpus named by BREACHED_PASSWORDS_FILE,
+// either a bloom filter made by the build-breach-filter command, a SHA-1
+// hash file sorted by hash or a directory of range files as published by
+// Have I Been Pwned. Without the variable breached passwords are not checked.
+func InitBreachChecker() error {
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		Breaches = nil
+		return nil
+	}
+	checker, err := OpenBreachCorpus(path)
+	if err != nil {
+		return err
+	}
+	Breaches = checker
+	log.Printf("Checking passwords against breach corpus %s\n", path)
+	return nil
+}
+
+// OpenBreachCorpus opens a bloom filter, a sorted hash file or a directory of
+// range files, telling the files apart by the bloom filter's magic header.
+// Corpora that don't look sorted by hash are refused, as lookups would miss.
+func OpenBreachCorpus(path string) (BreachChecker, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		ranges, err := newRangeDir(path)
+		if err != nil {
+			return nil, err
+		}
+		return ranges, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(bloomMagic))
+	_, err = io.ReadFull(file, magic)
+	if err == nil && string(magic) == bloomMagic {
+		defer file.Close()
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		return ReadBloomFilter(bufio.NewReader(file))
+	}
+	hashes, err := newHashFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// passwordHash is the SHA-1 of password, the hash breach corpora are published as
+func passwordHash(password string) [sha1.Size]byte {
+	return sha1.Sum([]byte(password))
+}
+
+/********************************************************
+* 					Sorted hash file					*
+*********************************************************/
+
+// hashFile looks passwords up in a file of "<SHA-1>:<count>" lines sorted by
+// hash with a binary search over the file, so corpora far larger than memory
+// can be used
+type hashFile struct {
+	file *os.File
+	size int64
+}
+
+func newHashFile(file *os.File) (*hashFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &hashFile{file: file, size: info.Size()}
+	err = f.validate()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", file.Name(), err)
+	}
+	return f, nil
+}
+
+func (f *hashFile) Breached(password string) (bool, error) {
+	sum := passwordHash(password)
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// Every line starting in [lo, hi) may still hold target
+	lo, hi := int64(0), f.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := f.lineFrom(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		hash := strings.ToUpper(strings.TrimSpace(line))
+		if i := strings.IndexByte(hash, ':'); i >= 0 {
+			hash = hash[:i]
+		}
+		switch {
+		case hash == target:
+			return true, nil
+		case hash < target:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// validate checks that the first lines of the file, and lines sampled across
+// the rest of it, are hash lines in ascending order. This catches the files
+// ordered by prevalence that are published next to the ones ordered by hash.
+func (f *hashFile) validate() error {
+	var order hashOrder
+	offset, checked := int64(0), 0
+	for ; checked < corpusCheckLines && offset < f.size; checked++ {
+		start, line, err := f.lineFrom(offset)
+		if err != nil {
+			return err
+		}
+		if start >= f.size {
+			break
+		}
+		if err = order.next("", line); err != nil {
+			return err
+		}
+		offset = start + int64(len(line)) + 1
+	}
+	if checked == 0 {
+		return util.ErrInvalidBreachCorpus
+	}
+	base := offset
+	for i := int64(1); i <= corpusSamples && base < f.size; i++ {
+		start, line, err := f.lineFrom(base + (f.size-base)*i/(corpusSamples+1))
+		if err != nil {
+			return err
+		}
+		if start >= f.size || start < offset {
+			continue
+		}
+		if err = order.next("", line); err != nil {
+			return err
+		}
+		offset = start + int64(len(line)) + 1
+	}
+	return nil
+}
+
+// lineFrom returns the first line starting at or after offset and where it
+// starts, or the file size when no line does
+func (f *hashFile) lineFrom(offset int64) (int64, string, error) {
+	reader := bufio.NewReader(io.NewSectionReader(f.file, offset, f.size-offset))
+	start := offset
+	if offset > 0 {
+		// Skip the rest of the line offset falls into, unless it starts there
+		prev := make([]byte, 1)
+		if _, err := f.file.ReadAt(prev, offset-1); err != nil {
+			return 0, "", err
+		}
+		if prev[0] != '\n' {
+			skipped, err := reader.ReadString('\n')
+			start += int64(len(skipped))
+			if err == io.EOF {
+				return f.size, "", nil
+			}
+			if err != nil {
+				return 0, "", err
+			}
+		}
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	if line == "" {
+		return f.size, "", nil
+	}
+	return start, strings.TrimSuffix(line, "\n"), nil
+}
+
+/********************************************************
+* 					Range files							*
+*********************************************************/
+
+// rangeDir looks passwords up in a directory of range files as written by the
+// Have I Been Pwned downloader: "<prefix>.txt" holds the "<suffix>:<count>"
+// lines, sorted by suffix, of every hash starting with the five hex digit prefix
+type rangeDir struct {
+	path string
+}
+
+func newRangeDir(path string) (*rangeDir, error) {
+	d := &rangeDir{path: path}
+	// Every range is published, so the first and the last have to be there
+	for _, prefix := range []string{"00000", "FFFFF"} {
+		err := d.validate(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.rangeFile(prefix), err)
+		}
+	}
+	return d, nil
+}
+
+func (d *rangeDir) Breached(password string) (bool, error) {
+	sum := passwordHash(password)
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, target := hash[:RangePrefixLen], hash[RangePrefixLen:]
+
+	file, err := os.Open(d.rangeFile(prefix))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		suffix := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if i := strings.IndexByte(suffix, ':'); i >= 0 {
+			suffix = suffix[:i]
+		}
+		switch {
+		case suffix == target:
+			return true, nil
+		case suffix > target:
+			return false, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// validate checks that the first lines of a range file are suffix lines in
+// ascending order
+func (d *rangeDir) validate(prefix string) error {
+	file, err := os.Open(d.rangeFile(prefix))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var order hashOrder
+	scanner := bufio.NewScanner(file)
+	checked := 0
+	for ; checked < corpusCheckLines && scanner.Scan(); checked++ {
+		if err = order.next(prefix, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if checked == 0 {
+		return util.ErrInvalidBreachCorpus
+	}
+	return nil
+}
+
+// rangeFile is the path of the range file of prefix
+func (d *rangeDir) rangeFile(prefix string) string {
+	return filepath.Join(d.path, prefix+".txt")
+}
+
+// hashOrder checks that the lines of a corpus are read in ascending hash order
+type hashOrder struct {
+	prev *[sha1.Size]byte
+}
+
+// next parses the hash line, prefixed with the range prefix of range files,
+// and fails unless it sorts after the previous one
+func (o *hashOrder) next(prefix, line string) error {
+	sum, _, err := ParseHashLine(prefix + line)
+	if err != nil {
+		return err
+	}
+	if o.prev != nil && bytes.Compare(sum[:], o.prev[:]) <= 0 {
+		return util.ErrUnsortedBreachCorpus
+	}
+	o.prev = &sum
+	return nil
+}
+
+/********************************************************
+* 					Bloom filter						*
+*********************************************************/
+
+// BloomFilter is a compact, probabilistic set of password hashes. It never
+// misses a breached password but may flag a small share of others.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+// NewBloomFilter sizes a filter for n hashes with the given false positive rate
+func NewBloomFilter(n uint64, falsePositiveRate float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// AddHash adds a SHA-1 password hash to the filter
+func (b *BloomFilter) AddHash(sum [sha1.Size]byte) {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// ContainsHash reports whether a SHA-1 password hash may be in the filter
+func (b *BloomFilter) ContainsHash(sum [sha1.Size]byte) bool {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BloomFilter) Breached(password string) (bool, error) {
+	return b.ContainsHash(passwordHash(password)), nil
+}
+
+// WriteTo stores the filter as its magic header, size, hash count and bits
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.LittleEndian.PutUint64(header[len(bloomMagic):], b.m)
+	binary.LittleEndian.PutUint32(header[len(bloomMagic)+8:], b.k)
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	// Filters can be gigabytes, so the bits are encoded a chunk at a time
+	chunk := make([]byte, 8*bloomChunkWords)
+	for i := 0; i < len(b.bits); i += bloomChunkWords {
+		words := b.bits[i:minInt(i+bloomChunkWords, len(b.bits))]
+		for j, word := range words {
+			binary.LittleEndian.PutUint64(chunk[8*j:], word)
+		}
+		n, err = w.Write(chunk[:8*len(words)])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadBloomFilter reads a filter stored by WriteTo
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	_, err := io.ReadFull(r, header)
+	if err != nil || !bytes.Equal(header[:len(bloomMagic)], []byte(bloomMagic)) {
+		return nil, util.ErrInvalidBreachCorpus
+	}
+	b := &BloomFilter{
+		m: binary.LittleEndian.Uint64(header[len(bloomMagic):]),
+		k: binary.LittleEndian.Uint32(header[len(bloomMagic)+8:]),
+	}
+	if b.m == 0 || b.k == 0 {
+		return nil, util.ErrInvalidBreachCorpus
+	}
+	b.bits = make([]uint64, (b.m+63)/64)
+	chunk := make([]byte, 8*bloomChunkWords)
+	for i := 0; i < len(b.bits); i += bloomChunkWords {
+		words := b.bits[i:minInt(i+bloomChunkWords, len(b.bits))]
+		_, err = io.ReadFull(r, chunk[:8*len(words)])
+		if err != nil {
+			return nil, util.ErrInvalidBreachCorpus
+		}
+		for j := range words {
+			words[j] = binary.LittleEndian.Uint64(chunk[8*j:])
+		}
+	}
+	return b, nil
+}
+
+// ParseHashLine parses a "<SHA-1>:<count>" line of a hash file. The count is
+// optional and defaults to 1. Lines of a range file parse once their range
+// prefix is put in front.
+func ParseHashLine(line string) ([sha1.Size]byte, int64, error) {
+	var sum [sha1.Size]byte
+	line = strings.TrimSpace(line)
+	hash, count := line, "1"
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		hash, count = line[:i], line[i+1:]
+	}
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != sha1.Size {
+		return sum, 0, util.ErrInvalidBreachCorpus
+	}
+	n, err := strconv.ParseInt(count, 10, 64)
+	if err != nil {
+		return sum, 0, util.ErrInvalidBreachCorpus
+	}
+	copy(sum[:], raw)
+	return sum, n, nil
+}
+
+// bloomHashes derives the two hashes the filter's bit positions are built from
+func bloomHashes(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
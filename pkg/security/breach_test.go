@@ -0,0 +1,227 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+)
+
+// Hashes of common passwords as published by Have I Been Pwned
+const (
+	passwordSHA1 = "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8" // password
+	numbersSHA1  = "7C4A8D09CA3762AF61E59520943DC26494F8941B" // 123456
+	qwertySHA1   = "B1B3773A05C0ED0176787A4F1574FF0075F7521E" // qwerty
+)
+
+func TestPasswordHash(t *testing.T) {
+	tests := map[string]string{
+		"password": passwordSHA1,
+		"123456":   numbersSHA1,
+		"qwerty":   qwertySHA1,
+	}
+	for password, want := range tests {
+		sum := passwordHash(password)
+		if got := strings.ToUpper(hex.EncodeToString(sum[:])); got != want {
+			t.Errorf("passwordHash(%q) = %s, want %s", password, got, want)
+		}
+	}
+}
+
+func TestParseHashLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		count int64
+		ok    bool
+	}{
+		{passwordSHA1 + ":9545824", 9545824, true},
+		{strings.ToLower(passwordSHA1) + ":3\r", 3, true},
+		{passwordSHA1, 1, true},
+		{passwordSHA1[:39] + ":1", 0, false},
+		{passwordSHA1 + ":many", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		sum, count, err := ParseHashLine(tt.line)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseHashLine(%q) error = %v, want ok %v", tt.line, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got := strings.ToUpper(hex.EncodeToString(sum[:])); got != passwordSHA1 || count != tt.count {
+			t.Errorf("ParseHashLine(%q) = %s, %d, want %s, %d", tt.line, got, count, passwordSHA1, tt.count)
+		}
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	lines := []string{passwordSHA1 + ":9545824", numbersSHA1 + ":37359195", qwertySHA1 + ":10556095"}
+	for i := 0; i < 1000; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("filler-%d", i)))
+		lines = append(lines, fmt.Sprintf("%X:%d", sum, i+1))
+	}
+	sort.Strings(lines)
+	path := writeCorpus(t, "hashes.txt", lines)
+
+	checker, err := OpenBreachCorpus(path)
+	if err != nil {
+		t.Fatalf("OpenBreachCorpus failed: %v", err)
+	}
+	tests := map[string]bool{
+		"password":          true,
+		"123456":            true,
+		"qwerty":            true,
+		"filler-0":          true,
+		"filler-999":        true,
+		"filler-1000":       false,
+		"Corr3ct-Horse-Bat": false,
+	}
+	for password, want := range tests {
+		got, err := checker.Breached(password)
+		if err != nil {
+			t.Fatalf("Breached(%q) failed: %v", password, err)
+		}
+		if got != want {
+			t.Errorf("Breached(%q) = %v, want %v", password, got, want)
+		}
+	}
+}
+
+func TestHashFileRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  error
+	}{
+		{"ordered by count", []string{numbersSHA1 + ":37359195", qwertySHA1 + ":10556095", passwordSHA1 + ":9545824"}, util.ErrUnsortedBreachCorpus},
+		{"duplicate hash", []string{passwordSHA1 + ":1", passwordSHA1 + ":2"}, util.ErrUnsortedBreachCorpus},
+		{"not hashes", []string{"password", "qwerty"}, util.ErrInvalidBreachCorpus},
+		{"empty", nil, util.ErrInvalidBreachCorpus},
+	}
+	for _, tt := range tests {
+		path := writeCorpus(t, "hashes.txt", tt.lines)
+		checker, err := OpenBreachCorpus(path)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: OpenBreachCorpus error = %v, want %v", tt.name, err, tt.want)
+		}
+		if checker != nil {
+			t.Errorf("%s: OpenBreachCorpus returned a checker for a refused corpus", tt.name)
+		}
+	}
+}
+
+func TestRangeDir(t *testing.T) {
+	dir := t.TempDir()
+	ranges := map[string][]string{
+		"00000": {suffixLine(0x5ad7, 10), suffixLine(0xa8da, 4)},
+		"FFFFF": {suffixLine(0x5b1c, 2), suffixLine(0xfffd, 1)},
+		"5BAA6": {suffixLine(0x1d4a, 3), passwordSHA1[RangePrefixLen:] + ":9545824", suffixLine(0xfff3d2, 1)},
+		"7C4A8": {suffixLine(0xa, 1)},
+	}
+	for prefix, lines := range ranges {
+		writeRange(t, dir, prefix, lines)
+	}
+
+	checker, err := OpenBreachCorpus(dir)
+	if err != nil {
+		t.Fatalf("OpenBreachCorpus failed: %v", err)
+	}
+	tests := map[string]bool{
+		"password": true,
+		"123456":   false,
+	}
+	for password, want := range tests {
+		got, err := checker.Breached(password)
+		if err != nil {
+			t.Fatalf("Breached(%q) failed: %v", password, err)
+		}
+		if got != want {
+			t.Errorf("Breached(%q) = %v, want %v", password, got, want)
+		}
+	}
+	// A range that wasn't downloaded can't tell
+	if _, err = checker.Breached("qwerty"); err == nil {
+		t.Error("Breached succeeded without its range file")
+	}
+}
+
+func TestRangeDirRefused(t *testing.T) {
+	incomplete := t.TempDir()
+	writeRange(t, incomplete, "00000", []string{suffixLine(0x5ad7, 10)})
+	if _, err := OpenBreachCorpus(incomplete); err == nil {
+		t.Error("OpenBreachCorpus accepted a directory without the last range")
+	}
+
+	unsorted := t.TempDir()
+	writeRange(t, unsorted, "00000", []string{suffixLine(0xa8da, 4), suffixLine(0x5ad7, 10)})
+	writeRange(t, unsorted, "FFFFF", []string{suffixLine(0x5b1c, 2)})
+	if _, err := OpenBreachCorpus(unsorted); !errors.Is(err, util.ErrUnsortedBreachCorpus) {
+		t.Errorf("OpenBreachCorpus error = %v, want %v", err, util.ErrUnsortedBreachCorpus)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.001)
+	for _, password := range []string{"password", "123456"} {
+		filter.AddHash(passwordHash(password))
+	}
+
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	read, err := ReadBloomFilter(&buf)
+	if err != nil {
+		t.Fatalf("ReadBloomFilter failed: %v", err)
+	}
+	tests := map[string]bool{
+		"password": true,
+		"123456":   true,
+		"qwerty":   false,
+	}
+	for password, want := range tests {
+		for _, f := range []*BloomFilter{filter, read} {
+			if got, _ := f.Breached(password); got != want {
+				t.Errorf("Breached(%q) = %v, want %v", password, got, want)
+			}
+		}
+	}
+}
+
+// writeCorpus writes the lines of a hash file into a temporary directory
+func writeCorpus(t *testing.T, name string, lines []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// suffixLine is the line of a range file for the hash suffix n
+func suffixLine(n uint64, count int) string {
+	return fmt.Sprintf("%0*X:%d", 2*sha1.Size-RangePrefixLen, n, count)
+}
+
+// writeRange writes the range file of prefix into dir
+func writeRange(t *testing.T, dir, prefix string, lines []string) {
+	t.Helper()
+	content := strings.Join(lines, "\r\n") + "\r\n"
+	if err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package security
+
+import (
+	"encoding/binary"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+)
+
+// cborMaxDepth bounds nesting so hostile input can't exhaust the stack
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR (RFC 8949) item of data and returns it
+// with the bytes that follow it. Only what WebAuthn uses is supported:
+// definite length integers, byte and text strings, arrays, maps and simple
+// values. Integers decode as int64, maps as map[interface{}]interface{}.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > cborMaxDepth {
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, util.ErrInvalidWebAuthn
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, util.ErrInvalidWebAuthn
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, util.ErrInvalidWebAuthn
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, util.ErrInvalidWebAuthn
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte{}, data[:arg]...), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, util.ErrInvalidWebAuthn
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, util.ErrInvalidWebAuthn
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, util.ErrInvalidWebAuthn
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, util.ErrInvalidWebAuthn
+}
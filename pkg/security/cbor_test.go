@@ -0,0 +1,170 @@
+package security
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// RFC 8949 appendix A, limited to what WebAuthn uses
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6161", "a"},
+		{"6449455446", "IETF"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(mustHex(t, tt.in))
+		if err != nil {
+			t.Errorf("decodeCBOR(%s) failed: %v", tt.in, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("decodeCBOR(%s) left %x", tt.in, rest)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCBOR(%s) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	got, rest, err := decodeCBOR(mustHex(t, "6161ff01"))
+	if err != nil || got != "a" || !bytes.Equal(rest, []byte{0xff, 0x01}) {
+		t.Errorf("decodeCBOR = %#v, %x, %v, want a, ff01", got, rest, err)
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"truncated argument", "19 03"},
+		{"integer overflow", "1b ffffffffffffffff"},
+		{"negative overflow", "3b ffffffffffffffff"},
+		{"truncated string", "62 61"},
+		{"indefinite length", "5f 41 61 ff"},
+		{"huge array", "9b ffffffffffffffff"},
+		{"truncated array", "83 01 02"},
+		{"byte string key", "a1 41 61 01"},
+		{"missing value", "a1 01"},
+		{"tag", "c1 1a 514b67b0"},
+		{"half float", "f9 3c00"},
+		{"too deep", strings.Repeat("81", cborMaxDepth+1) + "00"},
+	}
+	for _, tt := range tests {
+		if got, _, err := decodeCBOR(mustHex(t, tt.in)); err == nil {
+			t.Errorf("%s: decodeCBOR(%s) = %#v, want an error", tt.name, tt.in, got)
+		}
+	}
+}
+
+// mustHex decodes hex, ignoring spaces
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encodeCBOR encodes the values decodeCBOR returns, so tests can build
+// authenticator responses. Map keys are written in sorted order.
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		if n < 24 {
+			return []byte{major<<5 | byte(n)}
+		}
+		arg := make([]byte, 8)
+		binary.BigEndian.PutUint64(arg, n)
+		switch {
+		case n <= 0xff:
+			return append([]byte{major<<5 | 24}, arg[7:]...)
+		case n <= 0xffff:
+			return append([]byte{major<<5 | 25}, arg[6:]...)
+		case n <= 0xffffffff:
+			return append([]byte{major<<5 | 26}, arg[4:]...)
+		}
+		return append([]byte{major<<5 | 27}, arg...)
+	}
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		values := map[string][]byte{}
+		for key, value := range v {
+			encoded := encodeCBOR(key)
+			keys = append(keys, encoded)
+			values[string(encoded)] = encodeCBOR(value)
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		out := head(5, uint64(len(v)))
+		for _, key := range keys {
+			out = append(append(out, key...), values[string(key)]...)
+		}
+		return out
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	return []byte{0xf6}
+}
+
+func TestEncodeCBORRoundTrip(t *testing.T) {
+	value := map[interface{}]interface{}{
+		"fmt":      "none",
+		int64(-2):  bytes.Repeat([]byte{7}, 300),
+		"attStmt":  map[interface{}]interface{}{},
+		int64(1):   []interface{}{int64(-100000), true, "x"},
+		"authData": []byte{},
+	}
+	got, rest, err := decodeCBOR(encodeCBOR(value))
+	if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, value) {
+		t.Errorf("decodeCBOR(encodeCBOR(v)) = %#v, %x, %v", got, rest, err)
+	}
+}
@@ -0,0 +1,75 @@
+package security
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// IDTokenLifetime is how long an OpenID Connect ID token stays valid
+const IDTokenLifetime = time.Hour
+
+// Issuer is the issuer identifier of this server, the absolute URL it is
+// reached at without a trailing slash. Discovery and the ID tokens name it.
+var Issuer string
+
+// InitIssuer reads the issuer identifier from ISSUER_URL. It is required while
+// OpenID Connect is enabled, as the host a request names is chosen by whoever
+// sends it, so InitKeys has to run first.
+func InitIssuer() error {
+	issuer := strings.TrimSuffix(os.Getenv("ISSUER_URL"), "/")
+	if issuer == "" && !OIDCEnabled() {
+		return nil
+	}
+	parsed, err := url.Parse(issuer)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") ||
+		parsed.Host == "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return util.ErrInvalidIssuer
+	}
+	Issuer = issuer
+	return nil
+}
+
+// OIDCEnabled reports whether ID tokens can be issued. Clients verify them
+// against the published keys, which an HS256 secret never is.
+func OIDCEnabled() bool {
+	return JwtSigningMethod != jwt.SigningMethodHS256.Alg()
+}
+
+// IDClaims are the claims of an OpenID Connect ID token. Profile and email
+// claims are only filled in when the matching scope was granted.
+type IDClaims struct {
+	jwt.StandardClaims
+	Nonce         string `json:"nonce,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// NewIDToken signs an ID token for subject, issued by issuer to the client
+// named in audience
+func NewIDToken(issuer, subject, audience string, claims IDClaims) (string, error) {
+	if !OIDCEnabled() {
+		return "", util.ErrOIDCDisabled
+	}
+	key := Keys.Active()
+	if key == nil {
+		return "", util.ErrUnknownSigningKey
+	}
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Issuer:    issuer,
+		Subject:   subject,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(IDTokenLifetime).Unix(),
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Private)
+}
@@ -0,0 +1,99 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+// JWK is the RFC 7517 JSON representation of a public verification key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served from /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key as a JWK. Symmetric keys are never
+// published, so ok is false for them.
+func (k *SigningKey) JWK() (jwk JWK, ok bool) {
+	jwk = JWK{
+		Use: "sig",
+		Alg: k.Method.Alg(),
+		Kid: k.Kid,
+	}
+
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(pub.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = b64(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64(pub)
+	default:
+		return JWK{}, false
+	}
+
+	return jwk, true
+}
+
+// PublicJWKS returns the verification keys that other services may use to
+// validate tokens issued by this server
+func PublicJWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range Keys.Keys() {
+		if jwk, ok := key.JWK(); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint used as the default kid
+func (k *SigningKey) thumbprint() string {
+	jwk, ok := k.JWK()
+	if !ok {
+		return ""
+	}
+	// Only the required members, in lexicographic order, take part
+	members := struct {
+		Crv string `json:"crv,omitempty"`
+		E   string `json:"e,omitempty"`
+		Kty string `json:"kty"`
+		N   string `json:"n,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}{jwk.Crv, jwk.E, jwk.Kty, jwk.N, jwk.X, jwk.Y}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
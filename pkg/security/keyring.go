@@ -0,0 +1,126 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyRing holds every key that may still verify tokens, indexed by kid.
+// Exactly one key is active and signs new tokens; the keys it replaced keep
+// verifying tokens until their retirement date so rotation never invalidates
+// tokens that are still in flight.
+type KeyRing struct {
+	mu      sync.RWMutex
+	active  string
+	keys    map[string]*SigningKey
+	overlap time.Duration
+}
+
+// NewKeyRing returns an empty key ring. overlap is how long a key stays valid
+// for verification after it has been replaced.
+func NewKeyRing(overlap time.Duration) *KeyRing {
+	return &KeyRing{
+		keys:    make(map[string]*SigningKey),
+		overlap: overlap,
+	}
+}
+
+// Add registers a key for verification without making it active. Keys that
+// are already known are left untouched.
+func (r *KeyRing) Add(key *SigningKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[key.Kid]; !ok {
+		r.keys[key.Kid] = key
+	}
+}
+
+// Promote makes kid the signing key. Every other key without a retirement
+// date, including the previously active one, is scheduled to retire once the
+// overlap window has passed, and keys past their retirement date are dropped.
+func (r *KeyRing) Promote(kid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.keys[kid]
+	if !ok {
+		return util.ErrUnknownSigningKey
+	}
+	if r.active != kid {
+		log.Printf("Promoted signing key %s\n", kid)
+	}
+	key.RetireAt = time.Time{}
+	r.active = kid
+
+	now := time.Now()
+	for id, k := range r.keys {
+		switch {
+		case id == kid:
+		case k.RetireAt.IsZero():
+			k.RetireAt = now.Add(r.overlap)
+			log.Printf("Signing key %s retires at %s\n", id, k.RetireAt.Format(time.RFC3339))
+		case k.retired(now):
+			delete(r.keys, id)
+		}
+	}
+	return nil
+}
+
+// Active returns the key used to sign new tokens
+func (r *KeyRing) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[r.active]
+}
+
+// Lookup returns the verification key for kid. Tokens issued before key ids
+// were introduced carry no kid and are checked against the active key.
+func (r *KeyRing) Lookup(kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if kid == "" {
+		kid = r.active
+	}
+	key, ok := r.keys[kid]
+	if !ok || key.retired(time.Now()) {
+		return nil, util.ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+// Keys returns every key that has not yet retired, newest retirement first
+func (r *KeyRing) Keys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		if !k.retired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].RetireAt.IsZero() != keys[j].RetireAt.IsZero() {
+			return keys[i].RetireAt.IsZero()
+		}
+		return keys[i].RetireAt.After(keys[j].RetireAt)
+	})
+	return keys
+}
+
+// VerificationKeys maps every valid kid to its public key
+func (r *KeyRing) VerificationKeys() map[string]interface{} {
+	keys := make(map[string]interface{})
+	for _, k := range r.Keys() {
+		keys[k.Kid] = k.Public
+	}
+	return keys
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && now.After(k.RetireAt)
+}
@@ -0,0 +1,209 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const rsaKeyBits = 2048
+
+// SigningKey pairs a JWT signing method with the key material used to sign
+// and verify tokens. For HMAC methods Private and Public hold the same secret.
+// Kid identifies the key in token headers and RetireAt, when set, is the time
+// after which the key no longer verifies tokens.
+type SigningKey struct {
+	Kid      string
+	Method   jwt.SigningMethod
+	Private  interface{}
+	Public   interface{}
+	RetireAt time.Time
+}
+
+// NewHMACKey returns a symmetric signing key for the HS256 method
+func NewHMACKey(secret []byte) *SigningKey {
+	sum := sha256.Sum256(secret)
+	return &SigningKey{
+		Kid:     b64(sum[:12]),
+		Method:  jwt.SigningMethodHS256,
+		Private: secret,
+		Public:  secret,
+	}
+}
+
+// GenerateSigningKey creates a fresh asymmetric key pair for the given algorithm
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	method, err := signingMethod(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	var private crypto.Signer
+	switch method {
+	case jwt.SigningMethodRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case jwt.SigningMethodES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, util.ErrUnsupportedSigningMethod
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newAsymmetricKey(method, private), nil
+}
+
+// LoadSigningKey reads a PEM encoded private key from path and checks that it
+// matches the given algorithm. PKCS#8, PKCS#1 (RSA) and SEC 1 (EC) encodings
+// are accepted.
+func LoadSigningKey(alg, path string) (*SigningKey, error) {
+	method, err := signingMethod(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data in %s", util.ErrInvalidSigningKey, path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrInvalidSigningKey, err)
+	}
+
+	private, ok := parsed.(crypto.Signer)
+	if !ok || !keyMatchesMethod(private, method) {
+		return nil, fmt.Errorf("%w: %s does not hold a %s key", util.ErrInvalidSigningKey, path, alg)
+	}
+
+	return newAsymmetricKey(method, private), nil
+}
+
+// LoadKeyDir reads every signing key kept in dir. Asymmetric keys are PEM
+// files named <kid>.pem and HMAC secrets are raw files named <kid>.key. The
+// kid of the most recently modified file is returned as the key to promote.
+func LoadKeyDir(alg, dir string) (keys []*SigningKey, newest string, err error) {
+	method, err := signingMethod(alg)
+	if err != nil {
+		return nil, "", err
+	}
+	ext := ".pem"
+	if method == jwt.SigningMethodHS256 {
+		ext = ".key"
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	var newestTime time.Time
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		var key *SigningKey
+		if ext == ".key" {
+			secret, err := os.ReadFile(path)
+			if err != nil {
+				return nil, "", err
+			}
+			key = NewHMACKey([]byte(strings.TrimSpace(string(secret))))
+		} else {
+			key, err = LoadSigningKey(alg, path)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		key.Kid = strings.TrimSuffix(entry.Name(), ext)
+		keys = append(keys, key)
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, "", err
+		}
+		if info.ModTime().After(newestTime) {
+			newestTime = info.ModTime()
+			newest = key.Kid
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("%w: no %s files in %s", util.ErrInvalidSigningKey, ext, dir)
+	}
+	return keys, newest, nil
+}
+
+// IsAsymmetric reports whether the key can be published for offline verification
+func (k *SigningKey) IsAsymmetric() bool {
+	_, ok := k.Method.(*jwt.SigningMethodHMAC)
+	return !ok
+}
+
+func newAsymmetricKey(method jwt.SigningMethod, private crypto.Signer) *SigningKey {
+	key := &SigningKey{
+		Method:  method,
+		Private: private,
+		Public:  private.Public(),
+	}
+	key.Kid = key.thumbprint()
+	return key
+}
+
+func signingMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		return jwt.SigningMethodHS256, nil
+	case jwt.SigningMethodRS256.Alg():
+		return jwt.SigningMethodRS256, nil
+	case jwt.SigningMethodES256.Alg():
+		return jwt.SigningMethodES256, nil
+	case jwt.SigningMethodEdDSA.Alg():
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("%w: %s", util.ErrUnsupportedSigningMethod, alg)
+}
+
+func keyMatchesMethod(key crypto.Signer, method jwt.SigningMethod) bool {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return method == jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		return method == jwt.SigningMethodES256 && k.Curve == elliptic.P256()
+	case ed25519.PrivateKey:
+		return method == jwt.SigningMethodEdDSA
+	}
+	return false
+}
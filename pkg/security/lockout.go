@@ -0,0 +1,114 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLoginWindow         = 15 * time.Minute
+	defaultLoginDelayAfter     = 3
+	defaultLoginBaseDelay      = time.Second
+	defaultLoginMaxDelay       = time.Minute
+	defaultLoginLockoutAfter   = 10
+	defaultLoginLockoutTime    = 15 * time.Minute
+	defaultLoginIPLockoutAfter = 100
+)
+
+// LoginThrottlePolicy decides how failed sign ins slow down further attempts.
+// Failures are counted per account and per source IP, and forgotten once
+// Window passed without another one. From DelayAfter failures on, an account
+// waits BaseDelay before its next attempt, doubling with every failure up to
+// MaxDelay. LockoutAfter failures lock the account and IPLockoutAfter the
+// source IP for LockoutDuration. A threshold of zero turns its rule off.
+type LoginThrottlePolicy struct {
+	Window          time.Duration
+	DelayAfter      int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	IPLockoutAfter  int
+}
+
+// LoginThrottle is applied to every sign in with a password
+var LoginThrottle = LoginThrottlePolicy{
+	Window:          defaultLoginWindow,
+	DelayAfter:      defaultLoginDelayAfter,
+	BaseDelay:       defaultLoginBaseDelay,
+	MaxDelay:        defaultLoginMaxDelay,
+	LockoutAfter:    defaultLoginLockoutAfter,
+	LockoutDuration: defaultLoginLockoutTime,
+	IPLockoutAfter:  defaultLoginIPLockoutAfter,
+}
+
+// InitLoginThrottle configures the sign in throttle from the environment with
+// LOGIN_DELAY_AFTER, LOGIN_LOCKOUT_AFTER and LOGIN_IP_LOCKOUT_AFTER, and the
+// durations LOGIN_FAILURE_WINDOW, LOGIN_BASE_DELAY, LOGIN_MAX_DELAY and
+// LOGIN_LOCKOUT_DURATION, such as 15m.
+func InitLoginThrottle() error {
+	policy := LoginThrottle
+	for name, value := range map[string]*time.Duration{
+		"LOGIN_FAILURE_WINDOW":   &policy.Window,
+		"LOGIN_BASE_DELAY":       &policy.BaseDelay,
+		"LOGIN_MAX_DELAY":        &policy.MaxDelay,
+		"LOGIN_LOCKOUT_DURATION": &policy.LockoutDuration,
+	} {
+		if env := os.Getenv(name); env != "" {
+			d, err := time.ParseDuration(env)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%s: %w", name, util.ErrInvalidLoginThrottle)
+			}
+			*value = d
+		}
+	}
+	for name, value := range map[string]*int{
+		"LOGIN_DELAY_AFTER":      &policy.DelayAfter,
+		"LOGIN_LOCKOUT_AFTER":    &policy.LockoutAfter,
+		"LOGIN_IP_LOCKOUT_AFTER": &policy.IPLockoutAfter,
+	} {
+		if env := os.Getenv(name); env != "" {
+			n, err := strconv.ParseUint(env, 10, 31)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, util.ErrInvalidLoginThrottle)
+			}
+			*value = int(n)
+		}
+	}
+
+	if policy.MaxDelay < policy.BaseDelay {
+		return fmt.Errorf("%w: LOGIN_MAX_DELAY is shorter than LOGIN_BASE_DELAY", util.ErrInvalidLoginThrottle)
+	}
+	LoginThrottle = policy
+	return nil
+}
+
+// Delay is how long an account has to wait after its failures-th failed sign
+// in, zero while it is under DelayAfter
+func (p LoginThrottlePolicy) Delay(failures int) time.Duration {
+	if p.DelayAfter == 0 || failures < p.DelayAfter {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.DelayAfter; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Locked reports whether failures lock an account, or a source IP when ip
+// is set
+func (p LoginThrottlePolicy) Locked(failures int, ip bool) bool {
+	threshold := p.LockoutAfter
+	if ip {
+		threshold = p.IPLockoutAfter
+	}
+	return threshold > 0 && failures >= threshold
+}
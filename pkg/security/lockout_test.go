@@ -0,0 +1,66 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+// testThrottle has the default thresholds and delays of the sign in throttle
+var testThrottle = LoginThrottlePolicy{
+	DelayAfter:     3,
+	BaseDelay:      time.Second,
+	MaxDelay:       time.Minute,
+	LockoutAfter:   10,
+	IPLockoutAfter: 100,
+}
+
+func TestLoginThrottleDelay(t *testing.T) {
+	off := testThrottle
+	off.DelayAfter = 0
+	tests := []struct {
+		name     string
+		policy   LoginThrottlePolicy
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", testThrottle, 0, 0},
+		{"under the threshold", testThrottle, 2, 0},
+		{"at the threshold", testThrottle, 3, time.Second},
+		{"doubled", testThrottle, 4, 2 * time.Second},
+		{"doubled again", testThrottle, 6, 8 * time.Second},
+		{"last before the cap", testThrottle, 8, 32 * time.Second},
+		{"capped", testThrottle, 9, time.Minute},
+		{"far past the cap", testThrottle, 1000, time.Minute},
+		{"turned off", off, 1000, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Delay(tt.failures); got != tt.want {
+			t.Errorf("%s: Delay(%d) = %v, want %v", tt.name, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottleLocked(t *testing.T) {
+	off := testThrottle
+	off.LockoutAfter, off.IPLockoutAfter = 0, 0
+	tests := []struct {
+		name     string
+		policy   LoginThrottlePolicy
+		failures int
+		ip       bool
+		want     bool
+	}{
+		{"account under the threshold", testThrottle, 9, false, false},
+		{"account at the threshold", testThrottle, 10, false, true},
+		{"account past the threshold", testThrottle, 11, false, true},
+		{"ip under the threshold", testThrottle, 99, true, false},
+		{"ip at the threshold", testThrottle, 100, true, true},
+		{"account turned off", off, 1000, false, false},
+		{"ip turned off", off, 1000, true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Locked(tt.failures, tt.ip); got != tt.want {
+			t.Errorf("%s: Locked(%d, %v) = %v, want %v", tt.name, tt.failures, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+const (
+	opaqueTokenBytes = 32
+	// OneTimeCodeDigits is the length of a code users type in from an email
+	OneTimeCodeDigits = 6
+
+	minOneTimeCodeKeyBytes = 32
+)
+
+// oneTimeCodeKey keys the digests one time codes are stored under
+var oneTimeCodeKey []byte
+
+// InitOneTimeCodes reads ONE_TIME_CODE_KEY, the secret of at least 32 bytes
+// one time codes are stored keyed with. There are only a million codes, so a
+// plain digest of one is reversed as soon as it leaks; it is required.
+func InitOneTimeCodes() error {
+	key := os.Getenv("ONE_TIME_CODE_KEY")
+	if len(key) < minOneTimeCodeKeyBytes {
+		return util.ErrInvalidOneTimeCodeKey
+	}
+	oneTimeCodeKey = []byte(key)
+	return nil
+}
+
+// NewOpaqueToken returns a random URL-safe token with 256 bits of entropy
+func NewOpaqueToken() (string, error) {
+	buf := make([]byte, opaqueTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return b64(buf), nil
+}
+
+// HashToken returns the digest under which an opaque token is stored so a
+// leaked database never exposes usable tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashOneTimeCode returns the digest under which a one time code is stored,
+// an HMAC keyed with ONE_TIME_CODE_KEY
+func HashOneTimeCode(code string) string {
+	mac := hmac.New(sha256.New, oneTimeCodeKey)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewOneTimeCode returns a random numeric code of OneTimeCodeDigits digits.
+// It is short enough to type, so whatever accepts it has to limit attempts.
+func NewOneTimeCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < OneTimeCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", OneTimeCodeDigits, n), nil
+}
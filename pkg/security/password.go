@@ -1,15 +1,234 @@
 package security
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
 
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HasherArgon2id = "argon2id"
+	HasherBcrypt   = "bcrypt"
+
+	defaultArgon2Memory      = 64 * 1024 // KiB
+	defaultArgon2Iterations  = 3
+	defaultArgon2Parallelism = 2
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
+)
+
+// PasswordHasher hashes passwords into self describing strings that record
+// the algorithm and parameters used, so they can be verified after the
+// configuration changed.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password
+	Hash(password string) (string, error)
+	// Verify checks password against an encoded hash made by this algorithm
+	Verify(encoded, password string) error
+	// Owns reports whether encoded was made by this algorithm
+	Owns(encoded string) bool
+	// Current reports whether encoded was made with this hasher's parameters
+	Current(encoded string) bool
+}
+
+// Passwords hashes new passwords. Hashes made by any supported algorithm
+// still verify.
+var Passwords PasswordHasher = NewArgon2idHasher(defaultArgon2Memory, defaultArgon2Iterations, defaultArgon2Parallelism)
+
+// InitPasswordHasher configures password hashing from the environment.
+// PASSWORD_HASHER selects argon2id (default) or bcrypt. ARGON2_MEMORY (KiB),
+// ARGON2_ITERATIONS and ARGON2_PARALLELISM tune argon2id, BCRYPT_COST bcrypt.
+func InitPasswordHasher() error {
+	switch alg := os.Getenv("PASSWORD_HASHER"); alg {
+	case "", HasherArgon2id:
+		memory, err := envUint("ARGON2_MEMORY", defaultArgon2Memory)
+		if err != nil {
+			return err
+		}
+		iterations, err := envUint("ARGON2_ITERATIONS", defaultArgon2Iterations)
+		if err != nil {
+			return err
+		}
+		parallelism, err := envUint("ARGON2_PARALLELISM", defaultArgon2Parallelism)
+		if err != nil || parallelism > 255 {
+			return fmt.Errorf("ARGON2_PARALLELISM: %w", util.ErrInvalidHasherParams)
+		}
+		Passwords = NewArgon2idHasher(memory, iterations, uint8(parallelism))
+	case HasherBcrypt:
+		cost, err := envUint("BCRYPT_COST", uint32(bcrypt.DefaultCost))
+		if err != nil || int(cost) < bcrypt.MinCost || int(cost) > bcrypt.MaxCost {
+			return fmt.Errorf("BCRYPT_COST: %w", util.ErrInvalidHasherParams)
+		}
+		Passwords = NewBcryptHasher(int(cost))
+	default:
+		return fmt.Errorf("%w: %s", util.ErrUnsupportedHasher, alg)
+	}
+	return nil
+}
+
+// EncryptPassword hashes password with the configured hasher
 func EncryptPassword(password string) (string, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return Passwords.Hash(password)
+}
+
+// VerifyPassword checks password against a hash made by any supported algorithm
+func VerifyPassword(hashed, password string) error {
+	for _, hasher := range []PasswordHasher{argon2idHasher{}, bcryptHasher{}} {
+		if hasher.Owns(hashed) {
+			return hasher.Verify(hashed, password)
+		}
+	}
+	return util.ErrUnsupportedHasher
+}
+
+// NeedsRehash reports whether hashed was made with another algorithm or other
+// parameters than the configured hasher, and should be replaced once the
+// password is known.
+func NeedsRehash(hashed string) bool {
+	return !Passwords.Current(hashed)
+}
+
+/********************************************************
+* 						argon2id						*
+*********************************************************/
+
+// argon2idHasher stores hashes in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func NewArgon2idHasher(memory, iterations uint32, parallelism uint8) PasswordHasher {
+	return argon2idHasher{
+		memory:      memory,
+		iterations:  iterations,
+		parallelism: parallelism,
+	}
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, argon2KeyLength)
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		HasherArgon2id, argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h argon2idHasher) Verify(encoded, password string) error {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return util.ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h argon2idHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$"+HasherArgon2id+"$")
+}
+
+func (h argon2idHasher) Current(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	return err == nil && params == h &&
+		len(salt) == argon2SaltLength && len(key) == argon2KeyLength
+}
+
+// decodeArgon2id parses a PHC formatted argon2id hash
+func decodeArgon2id(encoded string) (argon2idHasher, []byte, []byte, error) {
+	var params argon2idHasher
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HasherArgon2id {
+		return params, nil, nil, util.ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, util.ErrInvalidPasswordHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	// argon2.IDKey panics without threads and never made a hash without memory
+	// or passes
+	if err != nil || params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, util.ErrInvalidPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, util.ErrInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, util.ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+/********************************************************
+* 						bcrypt							*
+*********************************************************/
+
+// bcryptHasher stores hashes in bcrypt's own modular crypt format,
+// $2a$<cost>$<salt and hash>, which is what PHC tooling expects for bcrypt
+type bcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) PasswordHasher {
+	return bcryptHasher{cost: cost}
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
 	if err != nil {
 		return "", err
 	}
 	return string(hashed), nil
 }
 
-func VerifyPassword(hashed, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+func (h bcryptHasher) Verify(encoded, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+}
+
+func (h bcryptHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h bcryptHasher) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == h.cost
+}
+
+// envUint reads an unsigned integer from the environment variable name,
+// returning fallback when it is not set
+func envUint(name string, fallback uint32) (uint32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%s: %w", name, util.ErrInvalidHasherParams)
+	}
+	return uint32(n), nil
 }
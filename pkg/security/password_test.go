@@ -0,0 +1,118 @@
+package security
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testSalt is the base64 of 16 zero bytes, the length hashes are salted with
+const testSalt = "AAAAAAAAAAAAAAAAAAAAAA"
+
+func TestDecodeArgon2id(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		ok      bool
+	}{
+		{"valid", "$argon2id$v=19$m=64,t=1,p=1$" + testSalt + "$YWJj", true},
+		{"too few parts", "$argon2id$v=19$m=64,t=1,p=1$" + testSalt, false},
+		{"too many parts", "$argon2id$v=19$m=64,t=1,p=1$" + testSalt + "$YWJj$", false},
+		{"other algorithm", "$argon2i$v=19$m=64,t=1,p=1$" + testSalt + "$YWJj", false},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$" + testSalt + "$YWJj", false},
+		{"missing version", "$argon2id$m=64,t=1,p=1$" + testSalt + "$YWJj$x", false},
+		{"bad parameters", "$argon2id$v=19$m=64;t=1;p=1$" + testSalt + "$YWJj", false},
+		{"parallelism overflow", "$argon2id$v=19$m=64,t=1,p=256$" + testSalt + "$YWJj", false},
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=1$" + testSalt + "$YWJj", false},
+		{"zero iterations", "$argon2id$v=19$m=64,t=0,p=1$" + testSalt + "$YWJj", false},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + testSalt + "$YWJj", false},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!!$YWJj", false},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$" + testSalt + "$!!!!", false},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + testSalt + "$", false},
+	}
+	for _, tt := range tests {
+		params, _, _, err := decodeArgon2id(tt.encoded)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: decodeArgon2id failed: %v", tt.name, err)
+			} else if params != (argon2idHasher{memory: 64, iterations: 1, parallelism: 1}) {
+				t.Errorf("%s: decodeArgon2id params = %+v", tt.name, params)
+			}
+			continue
+		}
+		if !errors.Is(err, util.ErrInvalidPasswordHash) {
+			t.Errorf("%s: decodeArgon2id error = %v, want %v", tt.name, err, util.ErrInvalidPasswordHash)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	argon2id, err := NewArgon2idHasher(64, 1, 1).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("argon2id Hash failed: %v", err)
+	}
+	bcrypted, err := NewBcryptHasher(bcrypt.MinCost).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("bcrypt Hash failed: %v", err)
+	}
+	tests := []struct {
+		name     string
+		hashed   string
+		password string
+		ok       bool
+	}{
+		{"argon2id", argon2id, "correct horse", true},
+		{"argon2id wrong password", argon2id, "battery staple", false},
+		{"bcrypt", bcrypted, "correct horse", true},
+		{"bcrypt wrong password", bcrypted, "battery staple", false},
+		{"bcrypt 2y", "$2y" + bcrypted[3:], "correct horse", true},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + testSalt + "$YWJj", "correct horse", false},
+		{"unknown algorithm", "$1$salt$hash", "correct horse", false},
+		{"empty hash", "", "correct horse", false},
+	}
+	for _, tt := range tests {
+		err := VerifyPassword(tt.hashed, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyPassword error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	defer func(hasher PasswordHasher) { Passwords = hasher }(Passwords)
+	current := NewArgon2idHasher(64, 1, 1)
+	argon2id, err := current.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("argon2id Hash failed: %v", err)
+	}
+	bcrypted, err := NewBcryptHasher(bcrypt.MinCost).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("bcrypt Hash failed: %v", err)
+	}
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hashed string
+		rehash bool
+	}{
+		{"same parameters", current, argon2id, false},
+		{"more memory", NewArgon2idHasher(128, 1, 1), argon2id, true},
+		{"more iterations", NewArgon2idHasher(64, 2, 1), argon2id, true},
+		{"more parallelism", NewArgon2idHasher(64, 1, 2), argon2id, true},
+		{"short salt", current, "$argon2id$v=19$m=64,t=1,p=1$AAAA$" + argon2id[len(argon2id)-43:], true},
+		{"malformed", current, "$argon2id$v=19$m=64,t=1,p=0$" + testSalt + "$YWJj", true},
+		{"bcrypt to argon2id", current, bcrypted, true},
+		{"same bcrypt cost", NewBcryptHasher(bcrypt.MinCost), bcrypted, false},
+		{"higher bcrypt cost", NewBcryptHasher(bcrypt.MinCost + 1), bcrypted, true},
+		{"argon2id to bcrypt", NewBcryptHasher(bcrypt.MinCost), argon2id, true},
+	}
+	for _, tt := range tests {
+		Passwords = tt.hasher
+		if got := NeedsRehash(tt.hashed); got != tt.rehash {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.rehash)
+		}
+	}
+}
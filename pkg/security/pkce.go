@@ -0,0 +1,30 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+const (
+	PKCEMethodPlain = "plain"
+	PKCEMethodS256  = "S256"
+)
+
+// VerifyCodeChallenge checks a PKCE code verifier against the challenge sent
+// with the authorization request (RFC 7636)
+func VerifyCodeChallenge(verifier, challenge, method string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	var computed string
+	switch method {
+	case PKCEMethodS256:
+		sum := sha256.Sum256([]byte(verifier))
+		computed = b64(sum[:])
+	case PKCEMethodPlain:
+		computed = verifier
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -0,0 +1,416 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// bcryptMaxBytes is where bcrypt silently truncates its input
+	bcryptMaxBytes = 72
+
+	defaultMinLength  = 8
+	defaultMinClasses = 2
+	defaultMinScore   = 2
+	defaultHistory    = 5
+
+	ViolationTooShort       = "too_short"
+	ViolationTooLong        = "too_long"
+	ViolationMissingClasses = "missing_classes"
+	ViolationUserInfo       = "contains_user_info"
+	ViolationTooWeak        = "too_weak"
+	ViolationBreached       = "breached"
+	ViolationReused         = "reused"
+)
+
+// PasswordPolicy is the set of rules new passwords have to follow. MinClasses
+// counts how many of lowercase, uppercase, digits and symbols must appear,
+// and MinScore is the lowest StrengthScore accepted. History is how many
+// earlier passwords can't be used again, and passwords older than MaxAge
+// expire unless it is zero.
+type PasswordPolicy struct {
+	MinLength  int
+	MaxBytes   int
+	MinClasses int
+	MinScore   int
+	History    int
+	MaxAge     time.Duration
+}
+
+// Policy is checked against every new password
+var Policy = PasswordPolicy{
+	MinLength:  defaultMinLength,
+	MaxBytes:   bcryptMaxBytes,
+	MinClasses: defaultMinClasses,
+	MinScore:   defaultMinScore,
+	History:    defaultHistory,
+}
+
+// InitPasswordPolicy configures the password policy from the environment with
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_BYTES, PASSWORD_MIN_CLASSES and
+// PASSWORD_MIN_SCORE, PASSWORD_HISTORY and PASSWORD_MAX_AGE, a duration
+// such as 2160h. It has to run after InitPasswordHasher, as bcrypt limits how
+// long a password can be.
+func InitPasswordPolicy() error {
+	policy := Policy
+	if value := os.Getenv("PASSWORD_MAX_AGE"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("PASSWORD_MAX_AGE: %w", util.ErrInvalidPolicy)
+		}
+		policy.MaxAge = maxAge
+	}
+	for name, value := range map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &policy.MinLength,
+		"PASSWORD_MAX_BYTES":   &policy.MaxBytes,
+		"PASSWORD_MIN_CLASSES": &policy.MinClasses,
+		"PASSWORD_MIN_SCORE":   &policy.MinScore,
+		"PASSWORD_HISTORY":     &policy.History,
+	} {
+		n, err := envUint(name, uint32(*value))
+		if err != nil {
+			return err
+		}
+		*value = int(n)
+	}
+
+	if _, ok := Passwords.(bcryptHasher); ok && policy.MaxBytes > bcryptMaxBytes {
+		return fmt.Errorf("%w: bcrypt ignores everything past %d bytes", util.ErrInvalidPolicy, bcryptMaxBytes)
+	}
+	if policy.MinClasses > 4 || policy.MinScore > 4 || policy.MinLength > policy.MaxBytes {
+		return util.ErrInvalidPolicy
+	}
+	Policy = policy
+	return nil
+}
+
+// CheckPassword checks password against the configured policy. userInputs are
+// values the password must not contain, such as the user's email and name.
+// Passwords found in the breach corpus are refused as well.
+func CheckPassword(password string, userInputs ...string) error {
+	violations := Policy.Check(password, userInputs...)
+	if Breaches != nil {
+		breached, err := Breaches.Breached(password)
+		if err != nil {
+			log.Printf("Breaches.Breached| breach check failed: %v\n", err)
+		}
+		if breached {
+			violations = append(violations, util.Violation{
+				Code:    ViolationBreached,
+				Message: "password appears in a list of breached passwords",
+			})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &util.ViolationsError{
+		Err:        util.ErrWeakPassword,
+		Violations: violations,
+	}
+}
+
+// Check returns every rule of the policy password breaks
+func (p PasswordPolicy) Check(password string, userInputs ...string) []util.Violation {
+	var violations []util.Violation
+
+	if n := len([]rune(password)); n < p.MinLength {
+		violations = append(violations, util.Violation{
+			Code:    ViolationTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if len(password) > p.MaxBytes {
+		violations = append(violations, util.Violation{
+			Code:    ViolationTooLong,
+			Message: fmt.Sprintf("password must be at most %d bytes long", p.MaxBytes),
+		})
+	}
+	if n := characterClasses(password); n < p.MinClasses {
+		violations = append(violations, util.Violation{
+			Code:    ViolationMissingClasses,
+			Message: fmt.Sprintf("password must use at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses),
+		})
+	}
+	if containsUserInput(password, userInputs) {
+		violations = append(violations, util.Violation{
+			Code:    ViolationUserInfo,
+			Message: "password must not contain your email address or name",
+		})
+	}
+	if score := StrengthScore(password, userInputs...); score < p.MinScore {
+		violations = append(violations, util.Violation{
+			Code:    ViolationTooWeak,
+			Message: fmt.Sprintf("password is too easy to guess, scoring %d of 4 where %d is required", score, p.MinScore),
+		})
+	}
+	return violations
+}
+
+// SetPassword makes password the user's new password. Passwords matching the
+// current one or one of the last Policy.History ones are refused. The
+// replaced hash is kept in the history and the time of the change recorded.
+func SetPassword(user *models.User, password string) error {
+	previous := user.PasswordHistory
+	if user.Password != "" {
+		previous = append([]string{user.Password}, previous...)
+	}
+	if len(previous) > Policy.History+1 {
+		previous = previous[:Policy.History+1]
+	}
+	for _, hashed := range previous {
+		if VerifyPassword(hashed, password) == nil {
+			return &util.ViolationsError{
+				Err: util.ErrPasswordReused,
+				Violations: []util.Violation{{
+					Code:    ViolationReused,
+					Message: fmt.Sprintf("password must differ from your current and last %d passwords", Policy.History),
+				}},
+			}
+		}
+	}
+
+	hashed, err := EncryptPassword(password)
+	if err != nil {
+		return err
+	}
+	if len(previous) > Policy.History {
+		previous = previous[:Policy.History]
+	}
+	user.Password = hashed
+	user.PasswordHistory = previous
+	user.PasswordChangedAt = time.Now()
+	return nil
+}
+
+// PasswordExpired reports whether the user's password is older than
+// Policy.MaxAge. Accounts that never changed their password count from their
+// creation.
+func PasswordExpired(user *models.User) bool {
+	if Policy.MaxAge == 0 {
+		return false
+	}
+	changed := user.PasswordChangedAt
+	if changed.IsZero() {
+		changed = user.CreatedAt
+	}
+	return time.Since(changed) > Policy.MaxAge
+}
+
+/********************************************************
+* 					Strength estimation					*
+*********************************************************/
+
+// commonWords are passwords and password fragments attackers try first
+var commonWords = []string{
+	"password", "passwort", "qwerty", "azerty", "letmein", "welcome", "admin",
+	"login", "master", "dragon", "monkey", "iloveyou", "sunshine", "princess",
+	"football", "baseball", "shadow", "superman", "batman", "trustno1",
+	"secret", "hello", "freedom", "whatever", "starwars", "computer",
+	"michael", "charlie", "jordan", "summer", "winter", "spring", "autumn",
+	"changeme", "default", "access", "user", "test", "guest", "root",
+}
+
+// keyboardRows are the sequences typed by running a finger along a keyboard
+var keyboardRows = []string{
+	"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "qwertzuiop", "azertyuiop",
+}
+
+// leet undoes the usual character substitutions before matching words
+var leet = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i",
+)
+
+// StrengthScore estimates how hard password is to guess on a scale from 0
+// (trivial) to 4 (strong), in the spirit of zxcvbn. Common words, user inputs,
+// repeats and sequences count for little; other characters count for the size
+// of the character set they are drawn from.
+func StrengthScore(password string, userInputs ...string) int {
+	bits := entropyBits(password, userInputs)
+	switch {
+	case bits < 20:
+		return 0
+	case bits < 30:
+		return 1
+	case bits < 40:
+		return 2
+	case bits < 50:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// entropyBits estimates the bits of entropy of password
+func entropyBits(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	perChar := math.Log2(float64(charsetSize(password)))
+	lower := leet.Replace(strings.ToLower(password))
+
+	// Words an attacker guesses whole are worth about as many bits as the
+	// size of the list they come from
+	var words []string
+	words = append(words, commonWords...)
+	for _, input := range userInputs {
+		words = append(words, userInputTokens(input)...)
+	}
+	covered := make([]bool, len(runes))
+	seen := make(map[string]bool)
+	bits := 0.0
+	for _, word := range words {
+		if len(word) < 3 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		for i := strings.Index(lower, word); i >= 0; {
+			start := len([]rune(lower[:i]))
+			for j := start; j < start+len([]rune(word)) && j < len(covered); j++ {
+				covered[j] = true
+			}
+			bits += 10
+			next := strings.Index(lower[i+len(word):], word)
+			if next < 0 {
+				break
+			}
+			i += len(word) + next
+		}
+	}
+
+	// Repeated, sequential and keyboard runs of three or more characters are
+	// worth two characters
+	for i := 0; i < len(runes); {
+		if covered[i] {
+			i++
+			continue
+		}
+		run := 1
+		for i+run < len(runes) && !covered[i+run] && patterned(runes[i+run-1], runes[i+run]) {
+			run++
+		}
+		if run >= 3 {
+			bits += 2 * perChar
+		} else {
+			bits += float64(run) * perChar
+		}
+		i += run
+	}
+	return bits
+}
+
+// patterned reports whether b follows a as part of a repeat, an alphabetic or
+// numeric sequence, or a keyboard row
+func patterned(a, b rune) bool {
+	a, b = unicode.ToLower(a), unicode.ToLower(b)
+	if d := b - a; d >= -1 && d <= 1 {
+		return true
+	}
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// charsetSize is the size of the character set password appears to be drawn from
+func charsetSize(password string) int {
+	size := 0
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			size += class.size
+		}
+	}
+	return size
+}
+
+// characterClasses counts which of lowercase, uppercase, digits and symbols
+// appear in password
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+// containsUserInput reports whether password contains any part of the user's
+// inputs that is long enough to matter
+func containsUserInput(password string, userInputs []string) bool {
+	lower := strings.ToLower(password)
+	for _, input := range userInputs {
+		for _, token := range userInputTokens(input) {
+			if strings.Contains(lower, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userInputTokens splits an email or name into the lowercase parts of at
+// least three characters a password could be built from
+func userInputTokens(input string) []string {
+	input = strings.ToLower(strings.TrimSpace(input))
+	local := input
+	if at := strings.Index(input, "@"); at >= 0 {
+		local = input[:at]
+	}
+	var tokens []string
+	if len(local) >= 3 {
+		tokens = append(tokens, local)
+	}
+	for _, token := range strings.FieldsFunc(local, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(token) >= 3 && token != local {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,132 @@
+package security
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxBytes: 72, MinClasses: 2, MinScore: 2}
+	inputs := []string{"ann.smith@example.com", "Ann Smith"}
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"strong", "Corr3ct-Horse-Battery", nil},
+		{"too short", "Xq7#kP", []string{ViolationTooShort}},
+		{"too long", strings.Repeat("Xq7#", 19), []string{ViolationTooLong}},
+		{"multibyte too long", strings.Repeat("Éñ7ü", 10) + "Xø", []string{ViolationTooLong}},
+		{"missing classes", "xkqzvjwmbf", []string{ViolationMissingClasses}},
+		{"user info", "Smith-Corr3ct-Horse", []string{ViolationUserInfo}},
+		{"common word", "P@ssw0rd", []string{ViolationTooWeak}},
+		{"keyboard row", "qwertyuiop", []string{ViolationMissingClasses, ViolationTooWeak}},
+		{"empty", "", []string{ViolationTooShort, ViolationMissingClasses, ViolationTooWeak}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, violation := range policy.Check(tt.password, inputs...) {
+			got = append(got, violation.Code)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Check(%q) = %v, want %v", tt.name, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestStrengthScore(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"password", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"abcdefghij", 0},
+		{"1234567890", 0},
+		{"xkqzv", 1},
+		{"xkqzvjw", 2},
+		{"xkqzvjwmb", 3},
+		{"x7#Kq9!mZ2@v", 4},
+		{"annsmith", 1},
+	}
+	for _, tt := range tests {
+		if got := StrengthScore(tt.password, "ann.smith@example.com"); got != tt.want {
+			t.Errorf("StrengthScore(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	defer func(hasher PasswordHasher, policy PasswordPolicy) {
+		Passwords, Policy = hasher, policy
+	}(Passwords, Policy)
+	Passwords = NewArgon2idHasher(64, 1, 1)
+	Policy.History = 2
+
+	user := &models.User{}
+	passwords := []string{"first-Passw0rd", "second-Passw0rd", "third-Passw0rd", "fourth-Passw0rd"}
+	for _, password := range passwords {
+		if err := SetPassword(user, password); err != nil {
+			t.Fatalf("SetPassword(%q) failed: %v", password, err)
+		}
+	}
+	if len(user.PasswordHistory) != Policy.History {
+		t.Fatalf("history has %d hashes, want %d", len(user.PasswordHistory), Policy.History)
+	}
+	if user.PasswordChangedAt.IsZero() {
+		t.Error("SetPassword did not record the time of the change")
+	}
+
+	tests := []struct {
+		password string
+		reused   bool
+	}{
+		{"fourth-Passw0rd", true},
+		{"third-Passw0rd", true},
+		{"second-Passw0rd", true},
+		{"first-Passw0rd", false},
+	}
+	for _, tt := range tests {
+		candidate := *user
+		err := SetPassword(&candidate, tt.password)
+		if got := errors.Is(err, util.ErrPasswordReused); got != tt.reused {
+			t.Errorf("SetPassword(%q) error = %v, want reused %v", tt.password, err, tt.reused)
+		}
+	}
+}
+
+func TestInitPasswordPolicy(t *testing.T) {
+	defer func(hasher PasswordHasher, policy PasswordPolicy) {
+		Passwords, Policy = hasher, policy
+	}(Passwords, Policy)
+	tests := []struct {
+		name     string
+		hasher   PasswordHasher
+		maxBytes string
+		ok       bool
+	}{
+		{"bcrypt limit", NewBcryptHasher(bcrypt.MinCost), "72", true},
+		{"past the bcrypt limit", NewBcryptHasher(bcrypt.MinCost), "73", false},
+		{"argon2id", NewArgon2idHasher(64, 1, 1), "1024", true},
+		{"shorter than the minimum length", NewArgon2idHasher(64, 1, 1), "4", false},
+	}
+	for _, tt := range tests {
+		Passwords = tt.hasher
+		t.Setenv("PASSWORD_MAX_BYTES", tt.maxBytes)
+		err := InitPasswordPolicy()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: InitPasswordPolicy error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, util.ErrInvalidPolicy) {
+			t.Errorf("%s: InitPasswordPolicy error = %v, want %v", tt.name, err, util.ErrInvalidPolicy)
+		}
+	}
+}
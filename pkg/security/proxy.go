@@ -0,0 +1,72 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	// ProxyHeader is the header the proxies in front of the server forward
+	// the client address in, such as X-Forwarded-For. Empty when clients
+	// connect directly.
+	ProxyHeader string
+
+	// TrustedProxies are the addresses and CIDR ranges of those proxies
+	TrustedProxies []string
+
+	trustedProxyNets []*net.IPNet
+)
+
+// InitTrustedProxies reads PROXY_HEADER and TRUSTED_PROXIES, a comma
+// separated list of the addresses or CIDR ranges of the proxies. Clients can
+// send the header themselves, so it is only read from those proxies and a
+// header without them is an error.
+func InitTrustedProxies() error {
+	header := os.Getenv("PROXY_HEADER")
+	var proxies []string
+	var nets []*net.IPNet
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("TRUSTED_PROXIES %s: %w", proxy, util.ErrInvalidTrustedProxies)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES %s: %w", proxy, util.ErrInvalidTrustedProxies)
+		}
+		proxies = append(proxies, proxy)
+		nets = append(nets, ipNet)
+	}
+	if header != "" && len(proxies) == 0 {
+		return fmt.Errorf("PROXY_HEADER needs TRUSTED_PROXIES: %w", util.ErrInvalidTrustedProxies)
+	}
+
+	ProxyHeader, TrustedProxies, trustedProxyNets = header, proxies, nets
+	return nil
+}
+
+// TrustedProxy reports whether ip belongs to one of the trusted proxies
+func TrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
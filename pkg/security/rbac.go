@@ -0,0 +1,90 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/models"
+)
+
+// Permission is a single action a user may be allowed to perform on other
+// accounts. Acting on your own account needs no permission.
+type Permission string
+
+const (
+	PermUsersRead   Permission = "users:read"
+	PermUsersWrite  Permission = "users:write"
+	PermUsersDelete Permission = "users:delete"
+	PermRolesWrite  Permission = "roles:write"
+
+	// PermClientsWrite grants OAuth clients the scopes they may request
+	// with the client credentials grant and access to introspection
+	PermClientsWrite Permission = "clients:write"
+
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// rolePermissions maps every known role to the permissions it grants
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {PermUsersRead, PermUsersWrite, PermUsersDelete, PermRolesWrite, PermClientsWrite},
+	RoleUser:  {},
+}
+
+// HasPermission reports whether user is granted perm by one of their roles or
+// directly. The legacy Admin flag counts as the admin role.
+func HasPermission(user *models.User, perm Permission) bool {
+	if user == nil {
+		return false
+	}
+	roles := user.Roles
+	if user.Admin {
+		roles = append([]string{RoleAdmin}, roles...)
+	}
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	for _, p := range user.Permissions {
+		if Permission(p) == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether user has the admin role
+func IsAdmin(user *models.User) bool {
+	if user == nil {
+		return false
+	}
+	return user.Admin || HasRole(user.Roles, RoleAdmin)
+}
+
+// HasRole reports whether roles contains role
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidRole reports whether role is known
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// ValidPermission reports whether perm is granted by any role
+func ValidPermission(perm string) bool {
+	for _, perms := range rolePermissions {
+		for _, p := range perms {
+			if string(p) == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package security
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -10,37 +11,147 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const (
+	defaultKeyOverlap = time.Hour
+
+	// AccessTokenLifetime is how long a signed access token stays valid
+	AccessTokenLifetime = 30 * time.Minute
+)
+
 var (
-	JwtSecretKey     = []byte(os.Getenv("JWT_SECRET_KEY"))
 	JwtSigningMethod = jwt.SigningMethodHS256.Name
+
+	// Keys holds the active signing key and the retired keys still accepted
+	// for verification
+	Keys = NewKeyRing(defaultKeyOverlap)
 )
 
+// InitKeys configures the token signing keys from the environment.
+// JWT_SIGNING_METHOD selects HS256 (default), RS256, ES256 or EdDSA and
+// JWT_KEY_OVERLAP sets how long a replaced key keeps verifying tokens.
+// See RotateKeys for where key material is read from.
+func InitKeys() error {
+	alg := os.Getenv("JWT_SIGNING_METHOD")
+	if alg == "" {
+		alg = jwt.SigningMethodHS256.Alg()
+	}
+	if _, err := signingMethod(alg); err != nil {
+		return err
+	}
+
+	overlap := defaultKeyOverlap
+	if value := os.Getenv("JWT_KEY_OVERLAP"); value != "" {
+		var err error
+		overlap, err = time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	JwtSigningMethod = alg
+	Keys = NewKeyRing(overlap)
+	return RotateKeys()
+}
+
+// RotateKeys loads the current key material and promotes it to be the
+// signing key, keeping the previous key around for verification. Keys are
+// read from JWT_KEYS_DIR when set (the most recently modified file is
+// promoted), otherwise from JWT_SECRET_KEY for HS256 or the PEM file in
+// JWT_PRIVATE_KEY_FILE. Without a key file a new key pair is generated.
+func RotateKeys() error {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		keys, newest, err := LoadKeyDir(JwtSigningMethod, dir)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			Keys.Add(key)
+		}
+		return Keys.Promote(newest)
+	}
+
+	var key *SigningKey
+	var err error
+	switch path := os.Getenv("JWT_PRIVATE_KEY_FILE"); {
+	case JwtSigningMethod == jwt.SigningMethodHS256.Alg():
+		key = NewHMACKey([]byte(os.Getenv("JWT_SECRET_KEY")))
+	case path != "":
+		key, err = LoadSigningKey(JwtSigningMethod, path)
+	default:
+		log.Printf("No JWT_PRIVATE_KEY_FILE set, generating an ephemeral %s key\n", JwtSigningMethod)
+		key, err = GenerateSigningKey(JwtSigningMethod)
+	}
+	if err != nil {
+		return err
+	}
+
+	Keys.Add(key)
+	return Keys.Promote(key.Kid)
+}
+
+// Claims are the claims carried by access tokens. Scope and ClientId are only
+// set for tokens issued through OAuth 2.0, and Session names the token family
+// the token was issued in.
+type Claims struct {
+	jwt.StandardClaims
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Session  string `json:"sid,omitempty"`
+}
+
 func NewToken(userId string) (string, error) {
-	claims := jwt.StandardClaims{
-		Id:        userId,
-		Issuer:    userId,
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(time.Minute * 30).Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JwtSecretKey)
+	return NewScopedToken(userId, "", "", "")
+}
+
+// NewScopedToken creates an access token for userId on behalf of an OAuth client
+// within the given session
+func NewScopedToken(userId, clientId, scope, session string) (string, error) {
+	key := Keys.Active()
+	if key == nil {
+		return "", util.ErrUnknownSigningKey
+	}
+	// A random jti keeps tokens minted within the same second distinct
+	jti, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	claims := Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   userId,
+			Issuer:    userId,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(AccessTokenLifetime).Unix(),
+		},
+		Scope:    scope,
+		ClientId: clientId,
+		Session:  session,
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Private)
 }
 
 func validateSignedMethod(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	kid, _ := token.Header["kid"].(string)
+	key, err := Keys.Lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Method.Alg() {
 		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
-	return JwtSecretKey, nil
+	return key.Public, nil
 }
 
-func ParseToken(tokenString string) (*jwt.StandardClaims, error) {
-	claims := new(jwt.StandardClaims)
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := new(Claims)
 	token, err := jwt.ParseWithClaims(tokenString, claims, validateSignedMethod)
 	if err != nil {
 		return nil, err
 	}
 	var ok bool
-	claims, ok = token.Claims.(*jwt.StandardClaims)
+	claims, ok = token.Claims.(*Claims)
 	if !ok || !token.Valid {
 		return nil, util.ErrInvalidAuthToken
 	}
@@ -0,0 +1,152 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+)
+
+const (
+	// TOTPPeriod is how long a TOTP code is valid for
+	TOTPPeriod = 30 * time.Second
+	// TOTPDigits is the length of a TOTP code
+	TOTPDigits = 6
+	// totpSkew is how many periods before and after the current one are
+	// accepted, to allow for clock drift
+	totpSkew = 1
+	// totpSecretBytes is the secret length RFC 4226 recommends for HMAC-SHA1
+	totpSecretBytes = 20
+
+	// RecoveryCodeCount is how many recovery codes a user gets at once
+	RecoveryCodeCount = 10
+	// recoveryCodeLength is the number of characters of a recovery code,
+	// giving 50 bits of entropy
+	recoveryCodeLength = 10
+)
+
+// totpEncoding encodes TOTP secrets the way authenticator apps expect them
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPIssuer names the service in authenticator apps, the default name when
+// empty
+var TOTPIssuer string
+
+// InitTOTP reads TOTP_ISSUER, the name of the service in authenticator apps.
+// Apps split the account label at its colon, so the name can't contain one.
+func InitTOTP() error {
+	issuer := strings.TrimSpace(os.Getenv("TOTP_ISSUER"))
+	if strings.Contains(issuer, ":") {
+		return util.ErrInvalidTOTPIssuer
+	}
+	TOTPIssuer = issuer
+	return nil
+}
+
+// NewTOTPSecret returns a random base32 encoded TOTP secret
+func NewTOTPSecret() (string, error) {
+	buf := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// TOTPURI returns the otpauth URI authenticator apps enroll a secret from
+func TOTPURI(issuer, account, secret string) string {
+	values := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(int(TOTPPeriod.Seconds()))},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// TOTPCode returns the RFC 6238 code of secret for the period containing t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, totpStep(t))
+}
+
+// VerifyTOTP checks code against secret at time t, allowing for clock drift.
+// It returns the time step the code belongs to, so a code can be refused once
+// its step was used.
+func VerifyTOTP(secret, code string, t time.Time) (int64, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != TOTPDigits {
+		return 0, util.ErrInvalidMFACode
+	}
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, util.ErrInvalidMFACode
+}
+
+// NewRecoveryCodes returns a set of random recovery codes, formatted as two
+// groups of five characters
+func NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, recoveryCodeLength*5/8)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode strips what users tend to add or change when typing a
+// recovery code back in
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) != recoveryCodeLength {
+		return code
+	}
+	return code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+}
+
+// totpStep is the number of periods since the Unix epoch at t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// totpCode is the HOTP value (RFC 4226) of secret for counter step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", util.ErrInvalidMFACode
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
@@ -0,0 +1,107 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the RFC 6238 test vectors
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode(%d) failed: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	late, err := TOTPCode(rfc6238Secret, now.Add(-2*TOTPPeriod))
+	if err != nil {
+		t.Fatalf("TOTPCode failed: %v", err)
+	}
+	tests := []struct {
+		name string
+		code string
+		step int64
+		ok   bool
+	}{
+		{"current period", "050471", 37037037, true},
+		{"previous period", "081804", 37037036, true},
+		{"spaces", " 050 471 ", 37037037, true},
+		{"wrong code", "123456", 0, false},
+		{"too short", "05047", 0, false},
+		{"two periods late", late, 0, false},
+	}
+	for _, tt := range tests {
+		step, err := VerifyTOTP(rfc6238Secret, tt.code, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyTOTP(%q) error = %v, want ok %v", tt.name, tt.code, err, tt.ok)
+			continue
+		}
+		if tt.ok && step != tt.step {
+			t.Errorf("%s: VerifyTOTP(%q) step = %d, want %d", tt.name, tt.code, step, tt.step)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"abcde-fghij", "abcde-fghij"},
+		{"ABCDEFGHIJ", "abcde-fghij"},
+		{" abc de-fgh ij ", "abcde-fghij"},
+		{"abc", "abc"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestInitTOTP(t *testing.T) {
+	defer func(issuer string) { TOTPIssuer = issuer }(TOTPIssuer)
+	tests := []struct {
+		env  string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{" Example ", "Example", true},
+		{"Example Inc", "Example Inc", true},
+		{"Example:Inc", "", false},
+	}
+	for _, tt := range tests {
+		TOTPIssuer = ""
+		t.Setenv("TOTP_ISSUER", tt.env)
+		err := InitTOTP()
+		if (err == nil) != tt.ok {
+			t.Errorf("InitTOTP(%q) error = %v, want ok %v", tt.env, err, tt.ok)
+			continue
+		}
+		if TOTPIssuer != tt.want {
+			t.Errorf("InitTOTP(%q) issuer = %q, want %q", tt.env, TOTPIssuer, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package security
+
+import (
+	"os"
+	"strconv"
+)
+
+// RequireVerifiedEmail refuses sign in to accounts whose address is not verified
+var RequireVerifiedEmail = false
+
+// InitEmailVerification configures email verification from the environment.
+// REQUIRE_VERIFIED_EMAIL blocks sign in until the address is verified.
+func InitEmailVerification() error {
+	value := os.Getenv("REQUIRE_VERIFIED_EMAIL")
+	if value == "" {
+		RequireVerifiedEmail = false
+		return nil
+	}
+	required, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	RequireVerifiedEmail = required
+	return nil
+}
@@ -0,0 +1,485 @@
+package security
+
+import (
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// WebAuthnTimeout is how long the user has to answer a WebAuthn ceremony
+const WebAuthnTimeout = 5 * time.Minute
+
+// COSE algorithms supported for WebAuthn credentials, in order of preference
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// COSEAlgorithms are offered to authenticators when registering
+var COSEAlgorithms = []int64{COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256}
+
+// Attestation statement formats that can be verified
+const (
+	AttestationNone    = "none"
+	AttestationPacked  = "packed"
+	AttestationFIDOU2F = "fido-u2f"
+)
+
+// Client data types of the two WebAuthn ceremonies
+const (
+	WebAuthnCreate = "webauthn.create"
+	WebAuthnGet    = "webauthn.get"
+)
+
+// Authenticator data flags
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+	authFlagExtensions   = 0x80
+)
+
+// oidFIDOAAGUID is the certificate extension carrying an authenticator's AAGUID
+var oidFIDOAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// RelyingParty is the site credentials are scoped to, and the origins its
+// pages are served from
+type RelyingParty struct {
+	Id      string
+	Name    string
+	Origins []string
+}
+
+var (
+	// WebAuthn is the relying party passkeys are registered with, nil while
+	// WebAuthn is not configured
+	WebAuthn *RelyingParty
+
+	// WebAuthnAttestation is the attestation conveyance asked of authenticators
+	WebAuthnAttestation = "none"
+)
+
+// InitWebAuthn configures the relying party from the environment.
+// WEBAUTHN_RP_ID is the domain credentials are scoped to and WEBAUTHN_ORIGINS
+// a comma separated list of the origins allowed to use them, which have to
+// be on that domain. Credentials are bound to both for good, so they are never
+// guessed: without them WebAuthn stays disabled. WEBAUTHN_RP_NAME is the name
+// shown to users and WEBAUTHN_ATTESTATION the attestation conveyance.
+func InitWebAuthn() error {
+	id := strings.ToLower(os.Getenv("WEBAUTHN_RP_ID"))
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if id == "" && origins == "" {
+		WebAuthn = nil
+		return nil
+	}
+	if id == "" || strings.ContainsAny(id, ":/") {
+		return fmt.Errorf("WEBAUTHN_RP_ID: %w", util.ErrInvalidWebAuthnConfig)
+	}
+
+	rp := &RelyingParty{Id: id, Name: os.Getenv("WEBAUTHN_RP_NAME")}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Path != "" || parsed.RawQuery != "" || !originOf(parsed, id) {
+			return fmt.Errorf("WEBAUTHN_ORIGINS %s: %w", origin, util.ErrInvalidWebAuthnConfig)
+		}
+		rp.Origins = append(rp.Origins, origin)
+	}
+	if len(rp.Origins) == 0 {
+		return fmt.Errorf("WEBAUTHN_ORIGINS: %w", util.ErrInvalidWebAuthnConfig)
+	}
+
+	switch attestation := os.Getenv("WEBAUTHN_ATTESTATION"); attestation {
+	case "":
+		WebAuthnAttestation = "none"
+	case "none", "indirect", "direct", "enterprise":
+		WebAuthnAttestation = attestation
+	default:
+		return fmt.Errorf("WEBAUTHN_ATTESTATION: %w", util.ErrInvalidWebAuthnConfig)
+	}
+
+	WebAuthn = rp
+	return nil
+}
+
+// originOf reports whether origin is a secure origin on the domain rpId, the
+// only origins browsers let use its credentials
+func originOf(origin *url.URL, rpId string) bool {
+	host := strings.ToLower(origin.Hostname())
+	if host != rpId && !strings.HasSuffix(host, "."+rpId) {
+		return false
+	}
+	return origin.Scheme == "https" || (origin.Scheme == "http" && host == "localhost")
+}
+
+// ClientData is the part of the client's collected data checked by the server
+type ClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// AuthenticatorData is the data an authenticator signs. The credential id and
+// public key are only present when registering.
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+// UserPresent reports whether the user touched the authenticator
+func (a *AuthenticatorData) UserPresent() bool {
+	return a.Flags&authFlagUserPresent != 0
+}
+
+// UserVerified reports whether the authenticator verified the user, with a
+// PIN or biometrics
+func (a *AuthenticatorData) UserVerified() bool {
+	return a.Flags&authFlagUserVerified != 0
+}
+
+// ParseClientData checks that clientDataJSON belongs to a ceremony of type
+// typ on one of the relying party's origins
+func ParseClientData(clientDataJSON []byte, typ string, rp *RelyingParty) (*ClientData, error) {
+	var data ClientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	if data.Type != typ || data.Challenge == "" {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return &data, nil
+		}
+	}
+	return nil, util.ErrWebAuthnOrigin
+}
+
+// ParseAuthenticatorData decodes authenticator data and checks it was made
+// for the relying party with the user present
+func ParseAuthenticatorData(raw []byte, rp *RelyingParty) (*AuthenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	data := &AuthenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if subtle.ConstantTimeCompare(data.RPIDHash, rpIdHash[:]) != 1 {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	if !data.UserPresent() {
+		return nil, util.ErrInvalidWebAuthn
+	}
+
+	rest := raw[37:]
+	if data.Flags&authFlagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, util.ErrInvalidWebAuthn
+		}
+		data.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, util.ErrInvalidWebAuthn
+		}
+		data.CredentialId, rest = rest[:idLength], rest[idLength:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		data.PublicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if data.Flags&authFlagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	return data, nil
+}
+
+// VerifyAttestation checks a registration response and returns the new
+// credential's authenticator data and the attestation format it came with.
+// Attestation certificates are checked to have signed the statement, but not
+// chained to a trusted root, as no authenticator metadata is kept.
+func VerifyAttestation(attestationObject, clientDataJSON []byte, rp *RelyingParty) (*AuthenticatorData, string, error) {
+	decoded, rest, err := decodeCBOR(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, "", util.ErrInvalidWebAuthn
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, "", util.ErrInvalidWebAuthn
+	}
+	format, _ := object["fmt"].(string)
+	rawAuthData, _ := object["authData"].([]byte)
+	statement, _ := object["attStmt"].(map[interface{}]interface{})
+	if statement == nil {
+		return nil, "", util.ErrInvalidWebAuthn
+	}
+
+	authData, err := ParseAuthenticatorData(rawAuthData, rp)
+	if err != nil {
+		return nil, "", err
+	}
+	if authData.CredentialId == nil {
+		return nil, "", util.ErrInvalidWebAuthn
+	}
+	alg, err := COSEKeyAlgorithm(authData.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	switch format {
+	case AttestationNone:
+		if len(statement) != 0 {
+			return nil, "", util.ErrInvalidWebAuthn
+		}
+	case AttestationPacked:
+		err = verifyPacked(statement, signed, authData, alg)
+	case AttestationFIDOU2F:
+		err = verifyFIDOU2F(statement, clientDataHash[:], authData)
+	default:
+		err = util.ErrUnsupportedAttestation
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return authData, format, nil
+}
+
+// VerifyAssertion checks the signature an authenticator made over its data
+// and the client data with the credential's COSE public key
+func VerifyAssertion(publicKey, rawAuthData, clientDataJSON, signature []byte) error {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	key, alg, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return err
+	}
+	return verifySignature(key, alg, signed, signature)
+}
+
+// COSEKeyAlgorithm returns the algorithm of a COSE public key
+func COSEKeyAlgorithm(publicKey []byte) (int64, error) {
+	_, alg, err := parseCOSEKey(publicKey)
+	return alg, err
+}
+
+/********************************************************
+* 				Attestation statements					*
+*********************************************************/
+
+// verifyPacked checks a packed attestation, either self attestation signed
+// with the credential key or one signed by an attestation certificate
+func verifyPacked(statement map[interface{}]interface{}, signed []byte, authData *AuthenticatorData, credentialAlg int64) error {
+	alg, _ := statement["alg"].(int64)
+	sig, _ := statement["sig"].([]byte)
+	if sig == nil {
+		return util.ErrInvalidWebAuthn
+	}
+
+	chain, hasChain := statement["x5c"].([]interface{})
+	if !hasChain {
+		if alg != credentialAlg {
+			return util.ErrInvalidWebAuthn
+		}
+		key, _, err := parseCOSEKey(authData.PublicKey)
+		if err != nil {
+			return err
+		}
+		return verifySignature(key, alg, signed, sig)
+	}
+
+	cert, err := attestationCertificate(chain)
+	if err != nil {
+		return err
+	}
+	if cert.Version != 3 || cert.IsCA {
+		return util.ErrInvalidWebAuthn
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidFIDOAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, authData.AAGUID) {
+			return util.ErrInvalidWebAuthn
+		}
+	}
+	return verifySignature(cert.PublicKey, alg, signed, sig)
+}
+
+// verifyFIDOU2F checks the attestation of a U2F security key, which signs a
+// fixed layout with its P-256 attestation key
+func verifyFIDOU2F(statement map[interface{}]interface{}, clientDataHash []byte, authData *AuthenticatorData) error {
+	sig, _ := statement["sig"].([]byte)
+	chain, _ := statement["x5c"].([]interface{})
+	if sig == nil || len(chain) != 1 {
+		return util.ErrInvalidWebAuthn
+	}
+	cert, err := attestationCertificate(chain)
+	if err != nil {
+		return err
+	}
+	certKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || certKey.Curve != elliptic.P256() {
+		return util.ErrInvalidWebAuthn
+	}
+	key, alg, err := parseCOSEKey(authData.PublicKey)
+	credentialKey, ok := key.(*ecdsa.PublicKey)
+	if err != nil || !ok || alg != COSEAlgES256 {
+		return util.ErrInvalidWebAuthn
+	}
+
+	signed := []byte{0x00}
+	signed = append(signed, authData.RPIDHash...)
+	signed = append(signed, clientDataHash...)
+	signed = append(signed, authData.CredentialId...)
+	signed = append(signed, elliptic.Marshal(elliptic.P256(), credentialKey.X, credentialKey.Y)...)
+	return verifySignature(certKey, COSEAlgES256, signed, sig)
+}
+
+// attestationCertificate parses the leaf of an x5c chain
+func attestationCertificate(chain []interface{}) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	der, _ := chain[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, util.ErrInvalidWebAuthn
+	}
+	return cert, nil
+}
+
+/********************************************************
+* 					COSE keys							*
+*********************************************************/
+
+// COSE key parameters, RFC 9053
+const (
+	coseKeyType  int64 = 1
+	coseKeyAlg   int64 = 3
+	coseKeyCurve int64 = -1
+	coseKeyX     int64 = -2
+	coseKeyY     int64 = -3
+	coseKeyN     int64 = -1
+	coseKeyE     int64 = -2
+
+	coseKeyTypeOKP int64 = 1
+	coseKeyTypeEC2 int64 = 2
+	coseKeyTypeRSA int64 = 3
+
+	coseCurveP256    int64 = 1
+	coseCurveEd25519 int64 = 6
+)
+
+// parseCOSEKey decodes a COSE public key of a supported algorithm
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, 0, util.ErrInvalidWebAuthn
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, util.ErrInvalidWebAuthn
+	}
+	kty, _ := key[coseKeyType].(int64)
+	alg, _ := key[coseKeyAlg].(int64)
+
+	switch {
+	case kty == coseKeyTypeEC2 && alg == COSEAlgES256:
+		crv, _ := key[coseKeyCurve].(int64)
+		x, _ := key[coseKeyX].([]byte)
+		y, _ := key[coseKeyY].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, util.ErrInvalidWebAuthn
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, util.ErrInvalidWebAuthn
+		}
+		return pub, alg, nil
+	case kty == coseKeyTypeOKP && alg == COSEAlgEdDSA:
+		crv, _ := key[coseKeyCurve].(int64)
+		x, _ := key[coseKeyX].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, util.ErrInvalidWebAuthn
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == coseKeyTypeRSA && alg == COSEAlgRS256:
+		n, _ := key[coseKeyN].([]byte)
+		e, _ := key[coseKeyE].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, util.ErrInvalidWebAuthn
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, util.ErrUnsupportedWebAuthnKey
+}
+
+// verifySignature checks sig over message with key according to the COSE
+// algorithm alg
+func verifySignature(key crypto.PublicKey, alg int64, message, sig []byte) error {
+	switch alg {
+	case COSEAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		digest := sha256.Sum256(message)
+		if ok && ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return nil
+		}
+	case COSEAlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if ok && ed25519.Verify(pub, message, sig) {
+			return nil
+		}
+	case COSEAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		digest := sha256.Sum256(message)
+		if ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	default:
+		return util.ErrUnsupportedWebAuthnKey
+	}
+	return util.ErrInvalidWebAuthn
+}
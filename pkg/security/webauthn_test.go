@@ -0,0 +1,262 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mixedmachine/user-auth-server/pkg/util"
+)
+
+func TestInitWebAuthn(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		origins     string
+		attestation string
+		want        *RelyingParty
+		ok          bool
+	}{
+		{name: "disabled", ok: true},
+		{name: "id only", id: "example.com"},
+		{name: "origins only", origins: "https://example.com"},
+		{
+			name: "origins on the domain", id: "Example.com", origins: "https://example.com, https://app.example.com/",
+			want: &RelyingParty{Id: "example.com", Origins: []string{"https://example.com", "https://app.example.com"}}, ok: true,
+		},
+		{
+			name: "localhost over http", id: "localhost", origins: "http://localhost:3000",
+			want: &RelyingParty{Id: "localhost", Origins: []string{"http://localhost:3000"}}, ok: true,
+		},
+		{name: "http origin", id: "example.com", origins: "http://example.com"},
+		{name: "other domain", id: "example.com", origins: "https://example.org"},
+		{name: "domain suffix", id: "example.com", origins: "https://notexample.com"},
+		{name: "origin with path", id: "example.com", origins: "https://example.com/login"},
+		{name: "id is a url", id: "https://example.com", origins: "https://example.com"},
+		{name: "no origins", id: "example.com", origins: " , "},
+		{
+			name: "direct attestation", id: "example.com", origins: "https://example.com", attestation: "direct",
+			want: &RelyingParty{Id: "example.com", Origins: []string{"https://example.com"}}, ok: true,
+		},
+		{name: "unknown attestation", id: "example.com", origins: "https://example.com", attestation: "full"},
+	}
+	defer func(rp *RelyingParty, attestation string) {
+		WebAuthn, WebAuthnAttestation = rp, attestation
+	}(WebAuthn, WebAuthnAttestation)
+
+	for _, tt := range tests {
+		t.Setenv("WEBAUTHN_RP_ID", tt.id)
+		t.Setenv("WEBAUTHN_ORIGINS", tt.origins)
+		t.Setenv("WEBAUTHN_ATTESTATION", tt.attestation)
+		WebAuthn = &RelyingParty{Id: "stale"}
+
+		err := InitWebAuthn()
+		if !tt.ok {
+			if !errors.Is(err, util.ErrInvalidWebAuthnConfig) {
+				t.Errorf("%s: InitWebAuthn error = %v, want %v", tt.name, err, util.ErrInvalidWebAuthnConfig)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: InitWebAuthn failed: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(WebAuthn, tt.want) {
+			t.Errorf("%s: WebAuthn = %+v, want %+v", tt.name, WebAuthn, tt.want)
+		}
+		if want := tt.attestation; want != "" && WebAuthnAttestation != want {
+			t.Errorf("%s: WebAuthnAttestation = %s, want %s", tt.name, WebAuthnAttestation, want)
+		}
+	}
+}
+
+func TestParseClientData(t *testing.T) {
+	rp := &RelyingParty{Id: "example.com", Origins: []string{"https://example.com"}}
+	tests := []struct {
+		name string
+		data string
+		typ  string
+		want error
+	}{
+		{"create", `{"type":"webauthn.create","challenge":"abc","origin":"https://example.com"}`, WebAuthnCreate, nil},
+		{"get", `{"type":"webauthn.get","challenge":"abc","origin":"https://example.com","crossOrigin":false}`, WebAuthnGet, nil},
+		{"wrong ceremony", `{"type":"webauthn.get","challenge":"abc","origin":"https://example.com"}`, WebAuthnCreate, util.ErrInvalidWebAuthn},
+		{"no challenge", `{"type":"webauthn.get","origin":"https://example.com"}`, WebAuthnGet, util.ErrInvalidWebAuthn},
+		{"other origin", `{"type":"webauthn.get","challenge":"abc","origin":"https://evil.example"}`, WebAuthnGet, util.ErrWebAuthnOrigin},
+		{"subdomain not listed", `{"type":"webauthn.get","challenge":"abc","origin":"https://app.example.com"}`, WebAuthnGet, util.ErrWebAuthnOrigin},
+		{"not json", `webauthn.get`, WebAuthnGet, util.ErrInvalidWebAuthn},
+	}
+	for _, tt := range tests {
+		data, err := ParseClientData([]byte(tt.data), tt.typ, rp)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: ParseClientData error = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && data.Challenge != "abc" {
+			t.Errorf("%s: ParseClientData challenge = %q, want abc", tt.name, data.Challenge)
+		}
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	rp := &RelyingParty{Id: "example.com"}
+	authenticator := newTestAuthenticator(t)
+	attested := authenticator.authData(rp.Id, authFlagUserPresent|authFlagAttested, 0)
+	withExtensions := append(authenticator.authData(rp.Id, authFlagUserPresent|authFlagExtensions, 7),
+		encodeCBOR(map[interface{}]interface{}{"credProtect": int64(2)})...)
+
+	tests := []struct {
+		name string
+		raw  []byte
+		rp   *RelyingParty
+		ok   bool
+	}{
+		{"assertion", authenticator.authData(rp.Id, authFlagUserPresent, 1), rp, true},
+		{"attested credential", attested, rp, true},
+		{"extensions", withExtensions, rp, true},
+		{"other relying party", authenticator.authData("example.org", authFlagUserPresent, 1), rp, false},
+		{"user not present", authenticator.authData(rp.Id, authFlagUserVerified, 1), rp, false},
+		{"trailing bytes", append(authenticator.authData(rp.Id, authFlagUserPresent, 1), 0), rp, false},
+		{"truncated", attested[:len(attested)-1], rp, false},
+		{"too short", make([]byte, 36), rp, false},
+	}
+	for _, tt := range tests {
+		data, err := ParseAuthenticatorData(tt.raw, tt.rp)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ParseAuthenticatorData error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil || tt.raw[32]&authFlagAttested == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(data.CredentialId, authenticator.id) || !reflect.DeepEqual(data.PublicKey, authenticator.publicKey) {
+			t.Errorf("%s: ParseAuthenticatorData credential = %x, %x", tt.name, data.CredentialId, data.PublicKey)
+		}
+	}
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	rp := &RelyingParty{Id: "example.com", Origins: []string{"https://example.com"}}
+	authenticator := newTestAuthenticator(t)
+	clientData := []byte(`{"type":"webauthn.create","challenge":"abc","origin":"https://example.com"}`)
+	authData := authenticator.authData(rp.Id, authFlagUserPresent|authFlagUserVerified|authFlagAttested, 0)
+	clientDataHash := sha256.Sum256(clientData)
+	selfSignature := authenticator.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	attestations := []struct {
+		name      string
+		format    string
+		statement map[interface{}]interface{}
+		want      error
+	}{
+		{"none", AttestationNone, map[interface{}]interface{}{}, nil},
+		{"packed self attestation", AttestationPacked, map[interface{}]interface{}{"alg": COSEAlgES256, "sig": selfSignature}, nil},
+		{"packed with another algorithm", AttestationPacked, map[interface{}]interface{}{"alg": COSEAlgEdDSA, "sig": selfSignature}, util.ErrInvalidWebAuthn},
+		{"packed signing something else", AttestationPacked, map[interface{}]interface{}{"alg": COSEAlgES256, "sig": authenticator.sign(t, authData)}, util.ErrInvalidWebAuthn},
+		{"none with a statement", AttestationNone, map[interface{}]interface{}{"sig": selfSignature}, util.ErrInvalidWebAuthn},
+		{"unsupported format", "tpm", map[interface{}]interface{}{}, util.ErrUnsupportedAttestation},
+	}
+	for _, tt := range attestations {
+		object := encodeCBOR(map[interface{}]interface{}{"fmt": tt.format, "attStmt": tt.statement, "authData": authData})
+		data, format, err := VerifyAttestation(object, clientData, rp)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: VerifyAttestation error = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && (format != tt.format || !reflect.DeepEqual(data.PublicKey, authenticator.publicKey)) {
+			t.Errorf("%s: VerifyAttestation = %s, %x", tt.name, format, data.PublicKey)
+		}
+	}
+
+	alg, err := COSEKeyAlgorithm(authenticator.publicKey)
+	if err != nil || alg != COSEAlgES256 {
+		t.Errorf("COSEKeyAlgorithm = %d, %v, want %d", alg, err, COSEAlgES256)
+	}
+
+	assertionData := []byte(`{"type":"webauthn.get","challenge":"def","origin":"https://example.com"}`)
+	assertionAuthData := authenticator.authData(rp.Id, authFlagUserPresent, 1)
+	assertionHash := sha256.Sum256(assertionData)
+	signature := authenticator.sign(t, append(append([]byte{}, assertionAuthData...), assertionHash[:]...))
+	other := newTestAuthenticator(t)
+
+	assertions := []struct {
+		name       string
+		publicKey  []byte
+		authData   []byte
+		clientData []byte
+		ok         bool
+	}{
+		{"signed", authenticator.publicKey, assertionAuthData, assertionData, true},
+		{"other key", other.publicKey, assertionAuthData, assertionData, false},
+		{"other authenticator data", authenticator.publicKey, authenticator.authData(rp.Id, authFlagUserPresent, 2), assertionData, false},
+		{"other client data", authenticator.publicKey, assertionAuthData, clientData, false},
+	}
+	for _, tt := range assertions {
+		err := VerifyAssertion(tt.publicKey, tt.authData, tt.clientData, signature)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyAssertion error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// testAuthenticator is a software authenticator holding one ES256 credential
+type testAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	publicKey []byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return &testAuthenticator{
+		id:  id,
+		key: key,
+		publicKey: encodeCBOR(map[interface{}]interface{}{
+			coseKeyType:  coseKeyTypeEC2,
+			coseKeyAlg:   COSEAlgES256,
+			coseKeyCurve: coseCurveP256,
+			coseKeyX:     x,
+			coseKeyY:     y,
+		}),
+	}
+}
+
+// authData builds the authenticator data for rpId, with the credential when
+// flags has it attested
+func (a *testAuthenticator) authData(rpId string, flags byte, signCount uint32) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append(rpIdHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], signCount)
+	if flags&authFlagAttested != 0 {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(append(data, a.id...), a.publicKey...)
+	}
+	return data
+}
+
+// sign signs message with the credential key
+func (a *testAuthenticator) sign(t *testing.T, message []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(message)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
@@ -3,13 +3,100 @@ package util
 import "errors"
 
 var (
-	ErrInvalidEmail       = errors.New("invalid email")
-	ErrEmailAlreadyExists = errors.New("email already exists")
-	ErrWikiAlreadyExists  = errors.New("wiki page already exists")
-	ErrEmptyUser          = errors.New("user can't be empty")
-	ErrEmptyName          = errors.New("name can't be empty")
-	ErrEmptyPassword      = errors.New("password can't be empty")
-	ErrInvalidAuthToken   = errors.New("invalid auth-token")
-	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrUnauthorized       = errors.New("unauthorized")
+	ErrInvalidEmail        = errors.New("invalid email")
+	ErrEmailAlreadyExists  = errors.New("email already exists")
+	ErrWikiAlreadyExists   = errors.New("wiki page already exists")
+	ErrEmptyUser           = errors.New("user can't be empty")
+	ErrEmptyName           = errors.New("name can't be empty")
+	ErrEmptyPassword       = errors.New("password can't be empty")
+	ErrInvalidAuthToken    = errors.New("invalid auth-token")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidResetToken   = errors.New("password reset token is invalid, expired or already used")
+	ErrForbidden           = errors.New("forbidden")
+	ErrPrivilegedField     = errors.New("roles, permissions and admin can't be set on signup")
+	ErrUnknownRole         = errors.New("unknown role")
+	ErrUnknownPermission   = errors.New("unknown permission")
+	ErrInvalidCursor       = errors.New("invalid cursor")
+	ErrInvalidSort         = errors.New("users can only be sorted by created_at, email or name")
+	ErrInvalidQuery        = errors.New("invalid query parameter")
+
+	ErrUnsupportedSigningMethod = errors.New("unsupported signing method")
+	ErrInvalidSigningKey        = errors.New("invalid signing key")
+	ErrUnknownSigningKey        = errors.New("unknown or retired signing key")
+	ErrInvalidIssuer            = errors.New("ISSUER_URL must be the absolute http(s) url of the server")
+	ErrOIDCDisabled             = errors.New("openid connect needs an asymmetric jwt signing method")
+
+	ErrUnsupportedHasher    = errors.New("unsupported password hasher")
+	ErrInvalidHasherParams  = errors.New("invalid password hasher parameters")
+	ErrInvalidPasswordHash  = errors.New("invalid password hash")
+	ErrWeakPassword         = errors.New("password does not meet the password policy")
+	ErrPasswordReused       = errors.New("password was used recently")
+	ErrInvalidPolicy        = errors.New("invalid password policy")
+	ErrInvalidBreachCorpus  = errors.New("invalid breached password corpus")
+	ErrUnsortedBreachCorpus = errors.New("breached password corpus is not sorted by hash")
+
+	ErrInvalidVerificationToken = errors.New("email verification link is invalid or expired")
+	ErrEmailNotVerified         = errors.New("email address is not verified")
+	ErrVerificationThrottled    = errors.New("a verification email was sent recently, try again later")
+
+	ErrInvalidMFAToken   = errors.New("mfa challenge is invalid, expired or failed too often")
+	ErrInvalidMFACode    = errors.New("invalid authentication code")
+	ErrMFAAlreadyEnabled = errors.New("an authenticator is already enabled")
+	ErrMFANotEnabled     = errors.New("no authenticator is enabled")
+	ErrNoMFAEnrollment   = errors.New("no authenticator enrollment is pending")
+	ErrInvalidTOTPIssuer = errors.New("TOTP_ISSUER must not contain a colon")
+
+	ErrInvalidWebAuthn           = errors.New("invalid webauthn response")
+	ErrWebAuthnDisabled          = errors.New("passkeys are not enabled")
+	ErrInvalidWebAuthnConfig     = errors.New("invalid webauthn configuration")
+	ErrInvalidWebAuthnChallenge  = errors.New("webauthn challenge is invalid or expired")
+	ErrWebAuthnOrigin            = errors.New("webauthn response comes from an unexpected origin")
+	ErrUnsupportedAttestation    = errors.New("unsupported attestation format")
+	ErrUnsupportedWebAuthnKey    = errors.New("unsupported credential public key")
+	ErrWebAuthnCredentialExists  = errors.New("credential is already registered")
+	ErrWebAuthnCredentialUnknown = errors.New("unknown credential")
+	ErrNoWebAuthnCredentials     = errors.New("no passkey is registered")
+	ErrWebAuthnUserVerification  = errors.New("the authenticator did not verify the user")
+	ErrWebAuthnSignCount         = errors.New("credential signature counter went backwards, the authenticator may be cloned")
+
+	ErrInvalidMagicLink         = errors.New("sign in link is invalid, expired or already used")
+	ErrInvalidSignInCode        = errors.New("sign in code is invalid, expired or failed too often")
+	ErrMagicSignInThrottled     = errors.New("a sign in email was sent recently, try again later")
+	ErrUnsupportedSignInMethod  = errors.New("sign in method must be link or code")
+	ErrMissingMagicSignInSecret = errors.New("a sign in token, or an email and code, are required")
+	ErrInvalidOneTimeCodeKey    = errors.New("ONE_TIME_CODE_KEY must be a secret of at least 32 bytes")
+
+	ErrSignInThrottled       = errors.New("too many failed sign in attempts, try again later")
+	ErrInvalidLoginThrottle  = errors.New("invalid sign in throttle configuration")
+	ErrInvalidTrustedProxies = errors.New("invalid trusted proxies")
+
+	ErrRateLimited          = errors.New("too many requests, try again later")
+	ErrRateLimitUnavailable = errors.New("rate limiting is unavailable, try again later")
+	ErrInvalidRateLimit     = errors.New("invalid rate limit configuration")
+
+	ErrUnsupportedMailDriver = errors.New("unsupported mail driver")
+	ErrInvalidMailConfig     = errors.New("invalid mail configuration")
+	ErrUnsupportedLocale     = errors.New("unsupported mail locale")
+	ErrUnknownMailTemplate   = errors.New("unknown mail template")
+	ErrInvalidRecipient      = errors.New("invalid mail recipient")
+	ErrMailQueueFull         = errors.New("mail queue is full")
+
+	ErrInvalidClient           = errors.New("unknown client")
+	ErrInvalidRedirectURI      = errors.New("redirect uri is not registered for this client")
+	ErrEmptyRedirectURIs       = errors.New("at least one redirect uri is required")
+	ErrInvalidGrant            = errors.New("authorization grant is invalid, expired or already used")
+	ErrInvalidCodeVerifier     = errors.New("code verifier does not match the code challenge")
+	ErrMissingCodeChallenge    = errors.New("a S256 or plain code challenge is required")
+	ErrUnsupportedGrantType    = errors.New("unsupported grant type")
+	ErrUnsupportedResponseType = errors.New("unsupported response type")
+	ErrAccessDenied            = errors.New("the user denied the request")
+	ErrInsufficientScope       = errors.New("token scope does not allow this request")
+	ErrInvalidScope            = errors.New("requested scope is not allowed for this client")
+	ErrClientNotConfidential   = errors.New("client is not allowed to use this grant")
+	ErrClientToken             = errors.New("tokens issued to OAuth clients can't be used with this API")
+	ErrPrivilegedClientField   = errors.New("client scopes and resource server access can only be granted by an administrator")
 )
@@ -0,0 +1,26 @@
+package util
+
+// OAuth 2.0 error codes (RFC 6749 section 5.2)
+const (
+	OAuthInvalidRequest          = "invalid_request"
+	OAuthInvalidClient           = "invalid_client"
+	OAuthInvalidGrant            = "invalid_grant"
+	OAuthUnauthorizedClient      = "unauthorized_client"
+	OAuthUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthUnsupportedResponseType = "unsupported_response_type"
+	OAuthInvalidScope            = "invalid_scope"
+	OAuthAccessDenied            = "access_denied"
+)
+
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func NewOAuthError(code string, err error) OAuthError {
+	oerr := OAuthError{Error: code}
+	if err != nil {
+		oerr.Description = err.Error()
+	}
+	return oerr
+}
@@ -0,0 +1,34 @@
+package util
+
+// Violation is one rule an input breaks
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ViolationsError reports every rule an input breaks at once instead of
+// stopping at the first one
+type ViolationsError struct {
+	Err        error
+	Violations []Violation
+}
+
+func (e *ViolationsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ViolationsError) Unwrap() error {
+	return e.Err
+}
+
+type VError struct {
+	Error      string      `json:"error"`
+	Violations []Violation `json:"violations"`
+}
+
+func NewVError(err *ViolationsError) VError {
+	return VError{
+		Error:      err.Error(),
+		Violations: err.Violations,
+	}
+}